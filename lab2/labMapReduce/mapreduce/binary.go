@@ -0,0 +1,430 @@
+package mapreduce
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+)
+
+// ENCODING_BINARY writes pairs as records in blocks of about BINARY_BLOCK_SIZE bytes:
+//
+//	block    BINARY_SYNC | length uint32 | records uint32 | codec byte | crc uint32 | payload
+//	record   uvarint key length | key | uvarint value length | value
+//
+// Integers of the header are big endian. The payload holds the records of the block,
+// compressed on its own with the codec of Task.Compression, whose id is the codec byte
+// (0 = uncompressed). crc is the CRC-32C of the header fields before it and of the
+// payload. A file is just its blocks, so files written one after the other can be read
+// as one, like the outputs of map operations fetched by a reducer.
+//
+// BINARY_SYNC starts every block. A reader can seek to the block boundary after any
+// offset by looking for it: bytes of a payload that happen to match are told apart by
+// the CRC.
+
+const (
+	// JSON and compressed files never start with it
+	BINARY_SYNC = "\x00MRB"
+
+	BINARY_HEADER_SIZE = len(BINARY_SYNC) + 13
+	BINARY_BLOCK_SIZE  = 64 * 1024
+
+	// Payloads are never bigger, so readers don't trust longer lengths. A pair that
+	// doesn't fit in a block of its own can't be written.
+	BINARY_MAX_PAYLOAD = 64 * 1024 * 1024
+)
+
+var binaryCRCTable = crc32.MakeTable(crc32.Castagnoli)
+
+// binaryWriter writes pairs to the underlying writer as blocks of records, see
+// ENCODING_BINARY. Flush writes the last block, it doesn't flush the underlying writer.
+type binaryWriter struct {
+	output      *countingWriter
+	compression Compression
+	codec       byte
+	compressor  io.WriteCloser // reused from block to block, nil until the first one
+	compressed  bytes.Buffer
+	block       []byte // records of the block being filled
+	records     uint32
+	written     int64 // bytes of the blocks before compression
+}
+
+func newBinaryWriter(w io.Writer, compression Compression) (*binaryWriter, error) {
+	writer := &binaryWriter{output: &countingWriter{writer: w}, compression: compression}
+
+	if compression != COMPRESSION_NONE {
+		id, err := compressionId(compression)
+		if err != nil {
+			return nil, err
+		}
+		writer.codec = id
+	}
+	return writer, nil
+}
+
+func (writer *binaryWriter) Write(kv KeyValue) error {
+	writer.block = binary.AppendUvarint(writer.block, uint64(len(kv.Key)))
+	writer.block = append(writer.block, kv.Key...)
+	writer.block = binary.AppendUvarint(writer.block, uint64(len(kv.Value)))
+	writer.block = append(writer.block, kv.Value...)
+	writer.records++
+
+	if len(writer.block) >= BINARY_BLOCK_SIZE {
+		return writer.writeBlock()
+	}
+	return nil
+}
+
+func (writer *binaryWriter) Flush() error {
+	return writer.writeBlock()
+}
+
+func (writer *binaryWriter) sizes() (int64, int64) {
+	return writer.written, writer.output.count
+}
+
+// writeBlock writes the records buffered so far as a block.
+func (writer *binaryWriter) writeBlock() error {
+	var (
+		err     error
+		payload []byte
+		header  []byte
+	)
+
+	if writer.records == 0 {
+		return nil
+	}
+
+	payload = writer.block
+	if writer.codec != 0 {
+		if payload, err = writer.compressBlock(); err != nil {
+			return err
+		}
+	}
+
+	if len(payload) > BINARY_MAX_PAYLOAD {
+		// Writing again won't make the pair smaller
+		return &DataError{Op: "encode", Err: fmt.Errorf("block of %v bytes is bigger than %v", len(payload), BINARY_MAX_PAYLOAD), Fatal: true}
+	}
+
+	header = make([]byte, BINARY_HEADER_SIZE)
+	fields := copy(header, BINARY_SYNC)
+	binary.BigEndian.PutUint32(header[fields:], uint32(len(payload)))
+	binary.BigEndian.PutUint32(header[fields+4:], writer.records)
+	header[fields+8] = writer.codec
+	binary.BigEndian.PutUint32(header[fields+9:], blockCRC(header, payload))
+
+	if _, err = writer.output.Write(header); err != nil {
+		return err
+	}
+	if _, err = writer.output.Write(payload); err != nil {
+		return err
+	}
+
+	writer.written += int64(BINARY_HEADER_SIZE + len(writer.block))
+	writer.block = writer.block[:0]
+	writer.records = 0
+	return nil
+}
+
+// blockCRC returns the CRC of a block from its header and payload.
+func blockCRC(header []byte, payload []byte) uint32 {
+	crc := crc32.Checksum(header[len(BINARY_SYNC):BINARY_HEADER_SIZE-4], binaryCRCTable)
+	return crc32.Update(crc, binaryCRCTable, payload)
+}
+
+// compressBlock returns the records buffered so far compressed on their own.
+func (writer *binaryWriter) compressBlock() ([]byte, error) {
+	var err error
+
+	writer.compressed.Reset()
+	if writer.compressor == nil {
+		if writer.compressor, err = newCodecWriter(&writer.compressed, writer.compression); err != nil {
+			return nil, err
+		}
+	} else {
+		// Every codec of the package can be reset
+		writer.compressor.(interface{ Reset(io.Writer) }).Reset(&writer.compressed)
+	}
+
+	if _, err = writer.compressor.Write(writer.block); err != nil {
+		return nil, err
+	}
+	if err = writer.compressor.Close(); err != nil {
+		return nil, err
+	}
+	return writer.compressed.Bytes(), nil
+}
+
+// binaryReader reads the pairs of blocks written by binaryWriter. Blocks that don't
+// match their CRC, and records cut short, return an error wrapping ErrCorrupt.
+type binaryReader struct {
+	source      *bufio.Reader
+	file        io.ReadSeeker // nil when the reader can't seek
+	size        int64         // of file, -1 when the reader can't seek
+	offset      int64         // of the next block, from the start of file
+	blockOffset int64         // of the current block
+	records     []byte        // rest of the current block
+	left        uint32        // records left in the current block
+}
+
+func newBinaryReader(source *bufio.Reader) *binaryReader {
+	return &binaryReader{source: source, size: -1}
+}
+
+// openBinaryFile returns a reader of the blocks in file, from its start, that can seek.
+// size is the one of file.
+func openBinaryFile(file io.ReadSeeker, size int64) *binaryReader {
+	return &binaryReader{source: bufio.NewReader(file), file: file, size: size}
+}
+
+func (reader *binaryReader) Decode(kv *KeyValue) error {
+	var err error
+
+	for reader.left == 0 {
+		if err = reader.readBlock(); err != nil {
+			return err
+		}
+	}
+
+	if kv.Key, err = reader.readString(); err != nil {
+		return err
+	}
+	if kv.Value, err = reader.readString(); err != nil {
+		return err
+	}
+	if reader.left--; reader.left == 0 && len(reader.records) > 0 {
+		return fmt.Errorf("%w: block at offset %v holds more than its records", ErrCorrupt, reader.blockOffset)
+	}
+	return nil
+}
+
+// readString reads a length-prefixed string of the current block.
+func (reader *binaryReader) readString() (string, error) {
+	length, n := binary.Uvarint(reader.records)
+	if n <= 0 || length > uint64(len(reader.records)-n) {
+		return "", fmt.Errorf("%w: record cut short in block at offset %v", ErrCorrupt, reader.blockOffset)
+	}
+
+	s := string(reader.records[n : n+int(length)])
+	reader.records = reader.records[n+int(length):]
+	return s, nil
+}
+
+// readBlock reads the next block and checks its CRC. Returns io.EOF if the source
+// ends before it.
+func (reader *binaryReader) readBlock() error {
+	var (
+		err     error
+		header  []byte
+		payload []byte
+	)
+
+	header = make([]byte, BINARY_HEADER_SIZE)
+	if _, err = io.ReadFull(reader.source, header); err == io.ErrUnexpectedEOF {
+		return fmt.Errorf("%w: block header at offset %v cut short", ErrCorrupt, reader.offset)
+	} else if err != nil {
+		return err
+	}
+
+	if !bytes.HasPrefix(header, []byte(BINARY_SYNC)) {
+		return fmt.Errorf("%w: no block at offset %v", ErrCorrupt, reader.offset)
+	}
+
+	fields := len(BINARY_SYNC)
+	length := binary.BigEndian.Uint32(header[fields:])
+	records := binary.BigEndian.Uint32(header[fields+4:])
+	codec := header[fields+8]
+	crc := binary.BigEndian.Uint32(header[fields+9:])
+
+	if !knownCodec(codec) {
+		return fmt.Errorf("%w: block at offset %v has unknown compression id %v", ErrCorrupt, reader.offset, codec)
+	}
+
+	// Checked before reading, so bytes of a payload that look like a header don't make
+	// seekBlock read up to the end of the file
+	if length > BINARY_MAX_PAYLOAD {
+		return fmt.Errorf("%w: block at offset %v is longer than %v bytes", ErrCorrupt, reader.offset, BINARY_MAX_PAYLOAD)
+	}
+	if reader.size >= 0 && reader.offset+int64(BINARY_HEADER_SIZE)+int64(length) > reader.size {
+		return fmt.Errorf("%w: block at offset %v is longer than the rest of the file", ErrCorrupt, reader.offset)
+	}
+
+	// A corrupt length can't be trusted to allocate the payload, so it's read as it comes
+	var buffer bytes.Buffer
+	if _, err = io.CopyN(&buffer, reader.source, int64(length)); err == io.EOF {
+		return fmt.Errorf("%w: block at offset %v cut short", ErrCorrupt, reader.offset)
+	} else if err != nil {
+		return err
+	}
+	payload = buffer.Bytes()
+
+	if blockCRC(header, payload) != crc {
+		return fmt.Errorf("%w: block at offset %v doesn't match its CRC", ErrCorrupt, reader.offset)
+	}
+
+	if codec != 0 {
+		codecR, err := newCodecReader(bytes.NewReader(payload), codec)
+		if err != nil {
+			return fmt.Errorf("%w: block at offset %v: %v", ErrCorrupt, reader.offset, err)
+		}
+		payload, err = io.ReadAll(codecR)
+		codecR.Close()
+		if err != nil {
+			return fmt.Errorf("%w: block at offset %v: %v", ErrCorrupt, reader.offset, err)
+		}
+	}
+
+	reader.blockOffset = reader.offset
+	reader.offset += int64(BINARY_HEADER_SIZE) + int64(length)
+	reader.records = payload
+	reader.left = records
+	return nil
+}
+
+// knownCodec returns true if id is the codec byte of an uncompressed block or of one
+// of the codecs of Compression.
+func knownCodec(id byte) bool {
+	if id == 0 {
+		return true
+	}
+	for _, known := range compressionIds {
+		if id == known {
+			return true
+		}
+	}
+	return false
+}
+
+// seekBlock moves the reader to the first block starting at offset or after it, and
+// returns the offset of that block. Returns io.EOF if there's none.
+func (reader *binaryReader) seekBlock(offset int64) (int64, error) {
+	if reader.file == nil {
+		return 0, errors.New("binary reader can't seek")
+	}
+
+	for {
+		if _, err := reader.file.Seek(offset, io.SeekStart); err != nil {
+			return 0, err
+		}
+		reader.source.Reset(reader.file)
+		reader.left = 0
+
+		skipped, err := reader.skipToSync()
+		if err != nil {
+			return 0, err
+		}
+		offset += skipped
+		reader.offset = offset
+
+		if err = reader.readBlock(); err == nil {
+			return offset, nil
+		} else if !errors.Is(err, ErrCorrupt) {
+			return 0, err
+		}
+
+		// Bytes of a payload that look like BINARY_SYNC
+		offset++
+	}
+}
+
+// skipToSync discards bytes of the source up to the next BINARY_SYNC and returns how
+// many. Returns io.EOF if the source ends before it.
+func (reader *binaryReader) skipToSync() (int64, error) {
+	var skipped int64
+
+	for {
+		buffered, err := reader.source.Peek(reader.source.Size())
+		if i := bytes.Index(buffered, []byte(BINARY_SYNC)); i >= 0 {
+			reader.source.Discard(i)
+			return skipped + int64(i), nil
+		}
+		if err != nil {
+			return 0, io.EOF
+		}
+
+		// The end of the buffer may be the start of BINARY_SYNC
+		n, _ := reader.source.Discard(len(buffered) - len(BINARY_SYNC) + 1)
+		skipped += int64(n)
+	}
+}
+
+// BinaryInputFormat reads files of ENCODING_BINARY, like the results of reduce
+// operations of a job, one record per pair. Files are split by byte ranges: a block
+// belongs to the split it starts in.
+type BinaryInputFormat struct{}
+
+func (BinaryInputFormat) Splits(path string, splitSize int64) ([]InputSplit, error) {
+	return byteRangeSplits(path, splitSize)
+}
+
+func (BinaryInputFormat) Name() string {
+	return "binary"
+}
+
+func (BinaryInputFormat) Open(split InputSplit) (RecordReader, error) {
+	var (
+		err    error
+		reader *binaryRecordReader
+	)
+
+	reader = &binaryRecordReader{path: split.Path, end: -1}
+	if split.Length > 0 {
+		reader.end = split.Offset + split.Length
+	}
+
+	if reader.file, err = os.Open(split.Path); err != nil {
+		return nil, err
+	}
+
+	info, err := reader.file.Stat()
+	if err != nil {
+		reader.file.Close()
+		return nil, err
+	}
+	reader.blocks = openBinaryFile(reader.file, info.Size())
+
+	offset, err := reader.blocks.seekBlock(split.Offset)
+	if err != nil && err != io.EOF {
+		reader.file.Close()
+		return nil, err
+	}
+
+	// No block starts in the split
+	reader.done = err == io.EOF || (reader.end >= 0 && offset >= reader.end)
+	return reader, nil
+}
+
+type binaryRecordReader struct {
+	file   *os.File
+	blocks *binaryReader
+	path   string
+	end    int64 // blocks starting here or after belong to the next split, -1 for none
+	done   bool
+}
+
+func (reader *binaryRecordReader) Next() (Record, error) {
+	var kv KeyValue
+
+	if reader.done {
+		return Record{}, io.EOF
+	}
+
+	// The next block belongs to the next split
+	if reader.blocks.left == 0 && reader.end >= 0 && reader.blocks.offset >= reader.end {
+		return Record{}, io.EOF
+	}
+
+	if err := reader.blocks.Decode(&kv); err != nil {
+		return Record{}, err
+	}
+	return Record{Path: reader.path, Offset: reader.blocks.blockOffset, Key: kv.Key, Value: kv.Value}, nil
+}
+
+func (reader *binaryRecordReader) Close() error {
+	return reader.file.Close()
+}
@@ -0,0 +1,207 @@
+package mapreduce
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+// binaryBlocks returns blocks of pairs whose values hold bytes that look like the
+// header of a block: one with a length that fits in the file and one with a length
+// that doesn't.
+func binaryBlocks(blocks int, pairsPerBlock int) [][]KeyValue {
+	fits := BINARY_SYNC + "\x00\x00\x00\x08\x00\x00\x00\x01"
+	huge := BINARY_SYNC + "\xff\xff\xff\xff\x00\x00\x00\x01"
+
+	pairs := make([][]KeyValue, blocks)
+	for b := range pairs {
+		for i := 0; i < pairsPerBlock; i++ {
+			value := fmt.Sprintf("value%v", i)
+			switch i % 7 {
+			case 3:
+				value += fits
+			case 5:
+				value += huge
+			}
+			pairs[b] = append(pairs[b], KeyValue{Key: fmt.Sprintf("key-%v-%v", b, i), Value: value})
+		}
+	}
+	return pairs
+}
+
+// writeBinaryBlocks encodes every element of blocks as a block of its own. Returns the
+// encoded blocks and the offset of each one.
+func writeBinaryBlocks(t *testing.T, blocks [][]KeyValue, compression Compression) ([]byte, []int64) {
+	var buffer bytes.Buffer
+
+	writer, err := newBinaryWriter(&buffer, compression)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	offsets := make([]int64, 0, len(blocks))
+	for _, pairs := range blocks {
+		offsets = append(offsets, int64(buffer.Len()))
+		for _, kv := range pairs {
+			if err = writer.Write(kv); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err = writer.Flush(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return buffer.Bytes(), offsets
+}
+
+// decodeAll returns every pair of data, or the first error decoding it.
+func decodeAll(data []byte) ([]KeyValue, error) {
+	var pairs []KeyValue
+
+	reader := newPairReader(bytes.NewReader(data))
+	for {
+		var kv KeyValue
+		if err := reader.Decode(&kv); err == io.EOF {
+			return pairs, nil
+		} else if err != nil {
+			return pairs, err
+		}
+		pairs = append(pairs, kv)
+	}
+}
+
+func flatten(blocks [][]KeyValue) []KeyValue {
+	var pairs []KeyValue
+	for _, block := range blocks {
+		pairs = append(pairs, block...)
+	}
+	return pairs
+}
+
+func TestBinaryRoundTrip(t *testing.T) {
+	blocks := binaryBlocks(4, 20)
+
+	for _, compression := range []Compression{COMPRESSION_NONE, COMPRESSION_GZIP, COMPRESSION_FLATE, COMPRESSION_ZLIB} {
+		data, _ := writeBinaryBlocks(t, blocks, compression)
+
+		pairs, err := decodeAll(data)
+		if err != nil {
+			t.Fatalf("compression '%v': %v", compression, err)
+		}
+		if !reflect.DeepEqual(pairs, flatten(blocks)) {
+			t.Errorf("compression '%v': decoded pairs differ from the ones written", compression)
+		}
+	}
+}
+
+func TestBinaryCRCMismatch(t *testing.T) {
+	for _, compression := range []Compression{COMPRESSION_NONE, COMPRESSION_GZIP} {
+		data, offsets := writeBinaryBlocks(t, binaryBlocks(3, 20), compression)
+
+		// A byte of the payload of the second block, then one of its CRC
+		for _, at := range []int64{offsets[1] + int64(BINARY_HEADER_SIZE) + 3, offsets[1] + int64(BINARY_HEADER_SIZE) - 1} {
+			corrupt := bytes.Clone(data)
+			corrupt[at] ^= 0x40
+
+			if _, err := decodeAll(corrupt); !errors.Is(err, ErrCorrupt) {
+				t.Errorf("compression '%v', byte %v changed: got error %v, want one wrapping ErrCorrupt", compression, at, err)
+			}
+		}
+	}
+}
+
+func TestBinaryLengthBeyondFile(t *testing.T) {
+	data, _ := writeBinaryBlocks(t, binaryBlocks(1, 5), COMPRESSION_NONE)
+
+	// The length of the block now goes past the end of the file
+	data[len(BINARY_SYNC)] = 0x7f
+
+	reader := openBinaryFile(bytes.NewReader(data), int64(len(data)))
+	if err := reader.readBlock(); !errors.Is(err, ErrCorrupt) {
+		t.Errorf("got error %v, want one wrapping ErrCorrupt", err)
+	}
+}
+
+func TestBinarySeekBlockSkipsFalseSync(t *testing.T) {
+	blocks := binaryBlocks(4, 15)
+	data, offsets := writeBinaryBlocks(t, blocks, COMPRESSION_NONE)
+
+	if bytes.Count(data, []byte(BINARY_SYNC)) <= len(blocks) {
+		t.Fatal("payloads hold no false BINARY_SYNC")
+	}
+
+	for offset := int64(0); offset <= int64(len(data)); offset++ {
+		want := -1
+		for b, blockOffset := range offsets {
+			if blockOffset >= offset {
+				want = b
+				break
+			}
+		}
+
+		reader := openBinaryFile(bytes.NewReader(data), int64(len(data)))
+		got, err := reader.seekBlock(offset)
+
+		if want < 0 {
+			if err != io.EOF {
+				t.Fatalf("seekBlock(%v) = %v, %v, want io.EOF", offset, got, err)
+			}
+			continue
+		}
+		if err != nil || got != offsets[want] {
+			t.Fatalf("seekBlock(%v) = %v, %v, want block %v at %v", offset, got, err, want, offsets[want])
+		}
+
+		var kv KeyValue
+		if err = reader.Decode(&kv); err != nil || kv != blocks[want][0] {
+			t.Fatalf("seekBlock(%v) then Decode = %v, %v, want %v", offset, kv, err, blocks[want][0])
+		}
+	}
+}
+
+func TestBinaryInputFormatSplits(t *testing.T) {
+	blocks := binaryBlocks(12, 25)
+	data, _ := writeBinaryBlocks(t, blocks, COMPRESSION_NONE)
+
+	path := filepath.Join(t.TempDir(), "pairs")
+	if err := os.WriteFile(path, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	size := int64(len(data))
+	for _, splitSize := range []int64{1, 97, 500, size / 5, size / 2, size - 1, size, 0} {
+		var pairs []KeyValue
+
+		splits, err := BinaryInputFormat{}.Splits(path, splitSize)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		for _, split := range splits {
+			reader, err := BinaryInputFormat{}.Open(split)
+			if err != nil {
+				t.Fatalf("split size %v, split %v: %v", splitSize, split, err)
+			}
+
+			for {
+				record, err := reader.Next()
+				if err == io.EOF {
+					break
+				} else if err != nil {
+					t.Fatalf("split size %v, split %v: %v", splitSize, split, err)
+				}
+				pairs = append(pairs, KeyValue{Key: record.Key, Value: record.Value})
+			}
+			reader.Close()
+		}
+
+		if !reflect.DeepEqual(pairs, flatten(blocks)) {
+			t.Errorf("split size %v: %v splits read %v pairs, want the %v written in order", splitSize, len(splits), len(pairs), len(flatten(blocks)))
+		}
+	}
+}
@@ -0,0 +1,45 @@
+package mapreduce
+
+import (
+	"net/rpc"
+)
+
+// SubmitJob queues a job on the master running at masterHostname, which must have been
+// started with ServeMaster. The chunks are the input files of the map operations and
+// must be readable by the workers, encoding is the one of its intermediate files and
+// inputFormat the one the chunks were split with (nil for chunks read by Task.Map).
+// Workers must have been started with the same input format. Returns the id of the
+// new job.
+func SubmitJob(masterHostname string, chunks []string, reduceJobs int, encoding Encoding, inputFormat InputFormat) (int, error) {
+	var (
+		err    error
+		client *rpc.Client
+		reply  SubmitJobReply
+	)
+
+	if client, err = rpc.Dial("tcp", masterHostname); err != nil {
+		return 0, err
+	}
+	defer client.Close()
+
+	err = client.Call("Master.SubmitJob", &SubmitJobArgs{chunks, reduceJobs, encoding, inputFormatName(inputFormat)}, &reply)
+	return reply.JobId, err
+}
+
+// WaitJob blocks until the job with jobId is done on the master running at
+// masterHostname. Returns the path of its final result file.
+func WaitJob(masterHostname string, jobId int) (string, error) {
+	var (
+		err    error
+		client *rpc.Client
+		reply  WaitJobReply
+	)
+
+	if client, err = rpc.Dial("tcp", masterHostname); err != nil {
+		return "", err
+	}
+	defer client.Close()
+
+	err = client.Call("Master.WaitJob", &WaitJobArgs{jobId}, &reply)
+	return reply.ResultFile, err
+}
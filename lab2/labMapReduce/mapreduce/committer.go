@@ -0,0 +1,106 @@
+package mapreduce
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"syscall"
+)
+
+// outputCommitter stages the output files of one attempt of an operation and makes
+// them visible all at once. Every attempt writes to its own temporary directory and
+// commit renames it to the final directory of the operation. Readers either see every
+// output file of an attempt or none of them, and only the first attempt to commit is
+// ever visible: the output of the others is discarded.
+type outputCommitter struct {
+	finalDir string
+	tempDir  string
+}
+
+// Returns the name of the directory where attempt stages the output that goes to
+// finalDir.
+func attemptDirName(finalDir string, attempt int) string {
+	return fmt.Sprintf("%v.attempt-%v", finalDir, attempt)
+}
+
+// newOutputCommitter prepares the temporary directory of attempt. Anything left there
+// by a previous run of the same attempt is discarded.
+func newOutputCommitter(finalDir string, attempt int) (committer *outputCommitter, err error) {
+	committer = &outputCommitter{
+		finalDir: finalDir,
+		tempDir:  attemptDirName(finalDir, attempt),
+	}
+
+	if err = os.RemoveAll(committer.tempDir); err != nil {
+		return nil, err
+	}
+
+	if err = os.MkdirAll(committer.tempDir, os.ModePerm); err != nil {
+		return nil, err
+	}
+	return committer, nil
+}
+
+// create creates an output file of the attempt. It's only visible after commit.
+func (committer *outputCommitter) create(name string) (*os.File, error) {
+	return os.Create(filepath.Join(committer.tempDir, name))
+}
+
+// commit makes the output of the attempt visible. Returns false if another attempt
+// committed first, in which case this one is discarded. Files must be synced and
+// closed before.
+func (committer *outputCommitter) commit() (bool, error) {
+	err := os.Rename(committer.tempDir, committer.finalDir)
+
+	if isExistError(err) {
+		committer.abort()
+		return false, nil
+	}
+
+	if err != nil {
+		return false, err
+	}
+
+	return true, syncDir(filepath.Dir(committer.finalDir))
+}
+
+// abort discards the output of the attempt.
+func (committer *outputCommitter) abort() {
+	_ = os.RemoveAll(committer.tempDir)
+}
+
+// commitFile makes tempName visible as fileName, unless fileName was already
+// committed. Returns false in that case and discards tempName.
+func commitFile(tempName string, fileName string) (bool, error) {
+	err := os.Link(tempName, fileName)
+	_ = os.Remove(tempName)
+
+	if isExistError(err) {
+		return false, nil
+	}
+
+	if err != nil {
+		return false, err
+	}
+
+	return true, syncDir(filepath.Dir(fileName))
+}
+
+// isExistError returns true if err means the target of a rename or link was already
+// there. Renaming a directory over one that isn't empty fails with ENOTEMPTY instead
+// of EEXIST.
+func isExistError(err error) bool {
+	return os.IsExist(err) || errors.Is(err, syscall.ENOTEMPTY)
+}
+
+// syncDir flushes the entries of dir, so committed names survive a crash.
+func syncDir(dir string) error {
+	file, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	return file.Sync()
+}
@@ -1,5 +1,7 @@
 package mapreduce
 
+import "time"
+
 // KeyValue is the type used to hold elements of maps and reduces results.
 type KeyValue struct {
 	Key   string
@@ -14,6 +16,106 @@ type Task struct {
 	Shuffle ShuffleFunc
 	Reduce  ReduceFunc
 
+	// Combine is optional. When set, it runs over the output of each map operation,
+	// once per reduce partition, before the intermediate files are written. It has
+	// the same signature as Reduce and must be safe to apply more than once.
+	Combine ReduceFunc
+
+	// ReduceByKey is an optional alternative to Reduce. When set, the framework sorts
+	// each reduce partition by key and calls it once per key with an iterator over
+	// that key's values. Reduce is not called in that case.
+	ReduceByKey ReduceByKeyFunc
+
+	// InputFormat is optional. When set, the input of each map operation is a split of
+	// it (see input.go) and MapRecord is called once per record of the split. Map is not
+	// called in that case. RunSequential reads the splits from InputFilePathChan
+	// instead of the chunks from InputChan.
+	InputFormat InputFormat
+	MapRecord   RecordMapFunc
+
+	// Counting versions of Map, MapRecord, Reduce, Combine and ReduceByKey. Each one is
+	// optional and called instead of the function it stands for when set, with the
+	// Counters of the operation it runs for as well, see counters.go.
+	CountingMap         CountingMapFunc
+	CountingMapRecord   CountingRecordMapFunc
+	CountingReduce      CountingReduceFunc
+	CountingCombine     CountingReduceFunc
+	CountingReduceByKey CountingReduceByKeyFunc
+
+	// ReduceMemoryLimit is the amount of reduce input, in bytes, that a reduce operation
+	// keeps in memory (0 = REDUCE_MEMORY_LIMIT). With ReduceByKey, bigger partitions are
+	// sorted on disk and results are written as they are produced.
+	ReduceMemoryLimit int
+
+	// Heartbeats sent by the master to registered workers. A worker that doesn't answer
+	// for HeartbeatTimeout is considered failed (0 = HEARTBEAT_INTERVAL/HEARTBEAT_TIMEOUT).
+	HeartbeatInterval time.Duration
+	HeartbeatTimeout  time.Duration
+
+	// Speculative execution. Once no operation of a phase is pending,
+	// operations running for longer than SpeculativeSlowdown times the mean duration
+	// of the completed ones get a backup attempt on an idle worker
+	// (0 = SPECULATIVE_SLOWDOWN). The first attempt to finish wins.
+	Speculative         bool
+	SpeculativeSlowdown float64
+
+	// Compression of the intermediate files: map outputs, merged partitions and results
+	// of reduce operations (COMPRESSION_NONE = uncompressed). Readers find the codec of
+	// a file in its header, see compress.go.
+	Compression Compression
+
+	// Encoding of the pairs in intermediate files (ENCODING_JSON = JSON documents), see
+	// encoding.go. RunMaster sends the one of its task to the workers with every
+	// operation, submitted jobs choose their own.
+	Encoding Encoding
+
+	// OutputFormat writes the final result of a job (nil = JSONLinesOutputFormat), see
+	// output.go. With SortedOutput its pairs are sorted by key instead of coming in
+	// partition order, so two runs of the same job write identical files.
+	// RunSequential hands its results to OutputChan, where each partition is sorted.
+	OutputFormat OutputFormat
+	SortedOutput bool
+
+	// Locality of map operations. LocalChunks is a glob of the input chunks on the disk
+	// of a worker, like "map/map-*", which it reports when registering (empty = none).
+	// Map operations wait up to LocalityDelay for a worker holding their chunk before
+	// running on any other (0 = LOCALITY_DELAY).
+	LocalChunks   string
+	LocalityDelay time.Duration
+
+	// OperationTimeout is how long the master waits for an attempt of an operation
+	// (0 = no deadline). An attempt that takes longer fails, is abandoned by its
+	// worker and the operation is run again.
+	OperationTimeout time.Duration
+
+	// StatusAddress is where the master serves its status and metrics over HTTP, see
+	// master_status.go (empty = no server).
+	StatusAddress string
+
+	// MetricsAddress is where a worker serves its metrics over HTTP (empty = no
+	// server). Every worker on a host needs its own.
+	MetricsAddress string
+
+	// TraceFile is where the master writes the timeline of every attempt of a job once
+	// it's over, in the Chrome trace event format (empty = no trace).
+	TraceFile string
+
+	// Resume makes RunMaster continue the job recorded in JOURNAL_FILE instead of
+	// starting a new one. Input chunks are taken from the journal, so
+	// InputFilePathChan isn't used.
+	Resume bool
+
+	// Partitioning of keys between reduce operations (PARTITION_HASH = with Shuffle),
+	// see partition.go. With PARTITION_RANGE, Shuffle is ignored and SplitPoints bound
+	// the key ranges of the partitions. When nil, they're sampled from the input of
+	// each job.
+	Partitioning Partitioning
+	SplitPoints  []string
+
+	// Counters of the operation the task is run for, handed to the counting map and
+	// reduce functions. Set by the framework.
+	counters *Counters
+
 	// Jobs
 	NumReduceJobs int
 	NumMapFiles   int
@@ -28,7 +130,18 @@ type Task struct {
 }
 
 type (
-	MapFunc     func([]byte) []KeyValue
-	ReduceFunc  func([]KeyValue) []KeyValue
-	ShuffleFunc func(*Task, string) int
+	MapFunc         func([]byte) []KeyValue
+	RecordMapFunc   func(Record) []KeyValue
+	ReduceFunc      func([]KeyValue) []KeyValue
+	ReduceByKeyFunc func(string, *ValueIterator) []KeyValue
+	ShuffleFunc     func(*Task, string) int
+)
+
+// Counting map and reduce functions also get the Counters of the operation they run
+// for, see counters.go.
+type (
+	CountingMapFunc         func([]byte, *Counters) []KeyValue
+	CountingRecordMapFunc   func(Record, *Counters) []KeyValue
+	CountingReduceFunc      func([]KeyValue, *Counters) []KeyValue
+	CountingReduceByKeyFunc func(string, *ValueIterator, *Counters) []KeyValue
 )
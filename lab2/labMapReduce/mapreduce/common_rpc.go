@@ -4,6 +4,8 @@ package mapreduce
 
 type RegisterArgs struct {
 	WorkerHostname string
+	Slots          int      // operations the worker runs at the same time
+	Chunks         []string // input chunks on the disk of the worker, see Task.LocalChunks
 }
 
 type RegisterReply struct {
@@ -12,6 +14,76 @@ type RegisterReply struct {
 }
 
 type RunArgs struct {
-	Id       int
-	FilePath string
+	JobId      int
+	JobToken   string
+	ReduceJobs int
+	Id         int
+	FilePath   string
+	Attempt    int
+	Encoding   Encoding // of the intermediate files of the job
+
+	// Partitioning of the keys of the job, decided by the master. Reduce operations
+	// sort the results of range partitions.
+	Partitioning Partitioning
+
+	// Map operations and samples only: split points of the job when it's range
+	// partitioned, and the input format its input was split with, see inputFormatName.
+	SplitPoints []string
+	InputFormat string
+
+	// Reduce operations only: hostname of the worker holding the output of each map
+	// operation, indexed by map id.
+	MapWorkers []string
+}
+
+type RunReply struct {
+	// Map operations whose output a reduce operation couldn't fetch. The reduce
+	// operation can only run again after they're run again.
+	LostMaps []int
+
+	// Counts of the counters incremented by the operation, see counters.go.
+	Counters map[string]int64
+}
+
+type SampleReply struct {
+	Keys []string // emitted by the map function, in order
+}
+
+type CancelArgs struct {
+	JobId   int
+	Proc    string
+	Id      int
+	Attempt int
+}
+
+type FetchArgs struct {
+	JobId    int
+	JobToken string
+	MapId    int
+	ReduceId int
+	Offset   int64
+}
+
+type FetchReply struct {
+	Data []byte
+	Done bool // Data ends the file
+}
+
+type SubmitJobArgs struct {
+	Chunks      []string
+	ReduceJobs  int
+	Encoding    Encoding
+	InputFormat string // see inputFormatName
+}
+
+type SubmitJobReply struct {
+	JobId int
+}
+
+type WaitJobArgs struct {
+	JobId int
+}
+
+type WaitJobReply struct {
+	ResultFile string
 }
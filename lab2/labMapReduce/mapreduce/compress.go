@@ -0,0 +1,239 @@
+package mapreduce
+
+import (
+	"bufio"
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"compress/zlib"
+	"fmt"
+	"io"
+	"log"
+)
+
+// Intermediate files, map outputs, merged partitions and results of reduce operations,
+// are compressed with the codec of Task.Compression. A compressed file starts with a
+// header of COMPRESSION_MAGIC and the id of its codec, so readers don't need to know
+// how it was written, and files without it are read as they are. A reducer fetches the
+// outputs of every map operation into a single file, one after the other: readers go
+// on with the next header when a stream ends, so workers with different settings can
+// run the same job.
+//
+// Files of ENCODING_BINARY have no such header: each of their blocks is compressed on
+// its own, see binary.go.
+
+type Compression string
+
+const (
+	COMPRESSION_NONE  Compression = ""
+	COMPRESSION_GZIP  Compression = "gzip"
+	COMPRESSION_FLATE Compression = "flate"
+	COMPRESSION_ZLIB  Compression = "zlib"
+
+	// JSON never starts with a NUL byte
+	COMPRESSION_MAGIC = "\x00MRZ"
+)
+
+// Ids of the codecs in the header of a compressed file
+var compressionIds = map[Compression]byte{
+	COMPRESSION_GZIP:  1,
+	COMPRESSION_FLATE: 2,
+	COMPRESSION_ZLIB:  3,
+}
+
+// compressionId returns the id of the codec of compression in headers.
+func compressionId(compression Compression) (byte, error) {
+	id, ok := compressionIds[compression]
+	if !ok {
+		return 0, unknownSettingError("compress", "compression", compression)
+	}
+	return id, nil
+}
+
+// unknownSettingError returns the error of a setting of the task, like its compression,
+// that op doesn't know. Running the operation again won't make it known.
+func unknownSettingError(op string, setting string, value interface{}) error {
+	return &DataError{Op: op, Err: fmt.Errorf("unknown %v '%v'", setting, value), Fatal: true}
+}
+
+// compressWriter compresses what's written to it into the underlying writer, after the
+// header of its codec, and counts the bytes before and after compression. Close must be
+// called to flush the codec, it doesn't close the underlying writer.
+type compressWriter struct {
+	codec   io.WriteCloser // nil when not compressing
+	output  *countingWriter
+	written int64 // bytes before compression
+}
+
+type countingWriter struct {
+	writer io.Writer
+	count  int64
+}
+
+func (counter *countingWriter) Write(p []byte) (int, error) {
+	n, err := counter.writer.Write(p)
+	counter.count += int64(n)
+	return n, err
+}
+
+func newCompressWriter(w io.Writer, compression Compression) (*compressWriter, error) {
+	writer := &compressWriter{output: &countingWriter{writer: w}}
+	if compression == COMPRESSION_NONE {
+		return writer, nil
+	}
+
+	id, err := compressionId(compression)
+	if err != nil {
+		return nil, err
+	}
+
+	if _, err = writer.output.Write(append([]byte(COMPRESSION_MAGIC), id)); err != nil {
+		return nil, err
+	}
+
+	writer.codec, err = newCodecWriter(writer.output, compression)
+	return writer, err
+}
+
+// newCodecWriter returns a writer compressing to w with the codec of compression.
+func newCodecWriter(w io.Writer, compression Compression) (io.WriteCloser, error) {
+	switch compression {
+	case COMPRESSION_GZIP:
+		return gzip.NewWriter(w), nil
+	case COMPRESSION_FLATE:
+		return flate.NewWriter(w, flate.DefaultCompression)
+	case COMPRESSION_ZLIB:
+		return zlib.NewWriter(w), nil
+	}
+	return nil, unknownSettingError("compress", "compression", compression)
+}
+
+// newCodecReader returns a reader decompressing r with the codec of id. When r is an
+// io.ByteReader, the codec doesn't read past the end of its stream.
+func newCodecReader(r io.Reader, id byte) (io.ReadCloser, error) {
+	switch id {
+	case compressionIds[COMPRESSION_GZIP]:
+		gzipR, err := gzip.NewReader(r)
+		if err != nil {
+			return nil, err
+		}
+		gzipR.Multistream(false)
+		return gzipR, nil
+	case compressionIds[COMPRESSION_FLATE]:
+		return flate.NewReader(r), nil
+	case compressionIds[COMPRESSION_ZLIB]:
+		return zlib.NewReader(r)
+	}
+	return nil, fmt.Errorf("unknown compression id %v", id)
+}
+
+func (writer *compressWriter) Write(p []byte) (int, error) {
+	writer.written += int64(len(p))
+	if writer.codec == nil {
+		return writer.output.Write(p)
+	}
+	return writer.codec.Write(p)
+}
+
+func (writer *compressWriter) Close() error {
+	if writer.codec == nil {
+		return nil
+	}
+	return writer.codec.Close()
+}
+
+// logCompression logs the bytes of what was written before and after compression.
+func logCompression(what string, compression Compression, written int64, compressed int64) {
+	if compression == COMPRESSION_NONE {
+		return
+	}
+
+	ratio := 100.0
+	if written > 0 {
+		ratio = 100 * float64(compressed) / float64(written)
+	}
+	log.Printf("Compressed %v with %v: %v bytes to %v (%.1f%%)\n", what, compression, written, compressed, ratio)
+}
+
+// decompressReader reads the decompressed content of files written by compressWriter,
+// one or more of them one after the other. Content without a header is read as it is,
+// up to the next header: JSON never has a NUL byte, so the magic can't be mistaken
+// for a pair.
+type decompressReader struct {
+	source *bufio.Reader
+	codec  io.ReadCloser // codec of the current compressed stream, nil out of one
+}
+
+func newDecompressReader(r io.Reader) io.Reader {
+	return &decompressReader{source: bufio.NewReader(r)}
+}
+
+func (reader *decompressReader) Read(p []byte) (int, error) {
+	if len(p) == 0 {
+		return 0, nil
+	}
+
+	for {
+		if reader.codec == nil {
+			n, err := reader.readPlain(p)
+			if n > 0 || err != nil {
+				return n, err
+			}
+
+			// The next byte starts a header
+			if err = reader.next(); err != nil {
+				return 0, err
+			}
+		}
+
+		n, err := reader.codec.Read(p)
+		if err == io.EOF {
+			// Only the compressed stream ended, another may follow
+			reader.codec.Close()
+			reader.codec = nil
+			if n == 0 {
+				continue
+			}
+			err = nil
+		}
+		return n, err
+	}
+}
+
+// readPlain reads content without a header into p, up to the next NUL byte.
+func (reader *decompressReader) readPlain(p []byte) (int, error) {
+	if _, err := reader.source.Peek(1); err != nil {
+		return 0, err
+	}
+
+	buffered, _ := reader.source.Peek(min(len(p), reader.source.Buffered()))
+	if i := bytes.IndexByte(buffered, 0); i >= 0 {
+		buffered = buffered[:i]
+	}
+
+	n := copy(p, buffered)
+	reader.source.Discard(n)
+	return n, nil
+}
+
+// next reads the header of the next compressed stream and opens its codec.
+func (reader *decompressReader) next() error {
+	var err error
+
+	header, _ := reader.source.Peek(len(COMPRESSION_MAGIC) + 1)
+	if !bytes.HasPrefix(header, []byte(COMPRESSION_MAGIC)) || len(header) <= len(COMPRESSION_MAGIC) {
+		return fmt.Errorf("%w: NUL byte out of a compression header", ErrCorrupt)
+	}
+	id := header[len(COMPRESSION_MAGIC)]
+	reader.source.Discard(len(header))
+
+	// The codecs read source through io.ByteReader, so they don't read past the end of
+	// their stream.
+	reader.codec, err = newCodecReader(reader.source, id)
+
+	if err != nil {
+		reader.codec = nil
+		return fmt.Errorf("%w: %v", ErrCorrupt, err)
+	}
+	return nil
+}
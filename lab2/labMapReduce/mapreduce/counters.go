@@ -0,0 +1,198 @@
+package mapreduce
+
+import (
+	"encoding/json"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+)
+
+// The counting map and reduce functions of a task, like Task.CountingMap, get the
+// Counters of the operation they run for, to count whatever they want by name, like
+// records they skipped. Tasks without them count nothing. A worker returns the counts
+// of an operation to the master with its reply. The master keeps the counts of the
+// attempt that completed each operation, and records them in the journal with it, so
+// attempts that lost the race and operations run again after a restart aren't counted
+// twice. Once a job is done, the totals are logged and written to its report, see
+// reportFileName.
+
+const (
+	REPORT_FILE = "report.json"
+)
+
+// Counters are named counts. They're safe to use from several goroutines, and a nil
+// *Counters ignores every increment.
+type Counters struct {
+	mutex  sync.Mutex
+	counts map[string]int64
+}
+
+func newCounters() *Counters {
+	return &Counters{counts: make(map[string]int64)}
+}
+
+// Add adds delta to the counter called name.
+func (counters *Counters) Add(name string, delta int64) {
+	if counters == nil {
+		return
+	}
+
+	counters.mutex.Lock()
+	defer counters.mutex.Unlock()
+	counters.counts[name] += delta
+}
+
+// Inc adds 1 to the counter called name.
+func (counters *Counters) Inc(name string) {
+	counters.Add(name, 1)
+}
+
+// Get returns the count of the counter called name.
+func (counters *Counters) Get(name string) int64 {
+	if counters == nil {
+		return 0
+	}
+
+	counters.mutex.Lock()
+	defer counters.mutex.Unlock()
+	return counters.counts[name]
+}
+
+// snapshot returns a copy of the counts, nil when there are none.
+func (counters *Counters) snapshot() map[string]int64 {
+	if counters == nil {
+		return nil
+	}
+
+	counters.mutex.Lock()
+	defer counters.mutex.Unlock()
+
+	if len(counters.counts) == 0 {
+		return nil
+	}
+
+	counts := make(map[string]int64, len(counters.counts))
+	for name, count := range counters.counts {
+		counts[name] = count
+	}
+	return counts
+}
+
+// addCounts adds every count of counts to the counters of the same name.
+func (counters *Counters) addCounts(counts map[string]int64) {
+	for name, count := range counts {
+		counters.Add(name, count)
+	}
+}
+
+// mapChunk calls the map function of task on a chunk of the input.
+func (task *Task) mapChunk(chunk []byte) []KeyValue {
+	if task.CountingMap != nil {
+		return task.CountingMap(chunk, task.counters)
+	}
+	return task.Map(chunk)
+}
+
+// mapRecord calls the record map function of task on a record of the input.
+func (task *Task) mapRecord(record Record) []KeyValue {
+	if task.CountingMapRecord != nil {
+		return task.CountingMapRecord(record, task.counters)
+	}
+	return task.MapRecord(record)
+}
+
+// reduce calls the reduce function of task on a whole partition.
+func (task *Task) reduce(data []KeyValue) []KeyValue {
+	if task.CountingReduce != nil {
+		return task.CountingReduce(data, task.counters)
+	}
+	return task.Reduce(data)
+}
+
+// hasCombine returns true if task combines the output of map operations.
+func (task *Task) hasCombine() bool {
+	return task.Combine != nil || task.CountingCombine != nil
+}
+
+// combine calls the combine function of task on a partition of a map output.
+func (task *Task) combine(data []KeyValue) []KeyValue {
+	if task.CountingCombine != nil {
+		return task.CountingCombine(data, task.counters)
+	}
+	return task.Combine(data)
+}
+
+// hasReduceByKey returns true if task reduces one key at a time.
+func (task *Task) hasReduceByKey() bool {
+	return task.ReduceByKey != nil || task.CountingReduceByKey != nil
+}
+
+// reduceByKey calls the per-key reduce function of task on the values of key.
+func (task *Task) reduceByKey(key string, values *ValueIterator) []KeyValue {
+	if task.CountingReduceByKey != nil {
+		return task.CountingReduceByKey(key, values, task.counters)
+	}
+	return task.ReduceByKey(key, values)
+}
+
+// jobReport is the report of a job written once it's done.
+type jobReport struct {
+	Job        int
+	MapOps     int
+	ReduceOps  int
+	ResultFile string `json:",omitempty"` // RunSequential hands its results to OutputChan
+	Counters   map[string]int64
+}
+
+// Returns the name of the file with the report of a job.
+func reportFileName(jobDir string) string {
+	return filepath.Join(jobDir, RESULT_PATH, REPORT_FILE)
+}
+
+// writeReport logs the counters of report and writes it to the report file of the job
+// in jobDir.
+func writeReport(jobDir string, report jobReport) error {
+	var names []string
+
+	for name := range report.Counters {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	if len(names) == 0 {
+		log.Printf("Job %v counted nothing\n", report.Job)
+	} else {
+		log.Printf("Counters of job %v:\n", report.Job)
+		for _, name := range names {
+			log.Printf("    %v: %v\n", name, report.Counters[name])
+		}
+	}
+
+	data, err := json.MarshalIndent(&report, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	fileName := reportFileName(jobDir)
+	if err = os.MkdirAll(filepath.Dir(fileName), os.ModePerm); err != nil {
+		return dataError("write report", fileName, err)
+	}
+	if err = os.WriteFile(fileName, append(data, '\n'), 0644); err != nil {
+		return dataError("write report", fileName, err)
+	}
+	log.Printf("Report of job %v written to %v\n", report.Job, fileName)
+	return nil
+}
+
+// operationCounts returns the totals of the counts of every operation in counts.
+func operationCounts(counts ...map[int]map[string]int64) map[string]int64 {
+	totals := newCounters()
+	for _, operations := range counts {
+		for _, operationCounts := range operations {
+			totals.addCounts(operationCounts)
+		}
+	}
+	return totals.snapshot()
+}
@@ -1,189 +1,343 @@
 package mapreduce
 
 import (
-	"encoding/json"
+	"bufio"
 	"fmt"
+	"io"
 	"log"
 	"os"
 	"path/filepath"
-	"time"
 )
 
 const (
 	REDUCE_PATH = "reduce/"
 	RESULT_PATH = "result/"
-
-	OPEN_FILE_MAX_RETRY = 3
+	JOBS_PATH   = "jobs/"
 )
 
+// Returns the directory where a job keeps its reduce and result files. Job 0 is the
+// single job run by RunMaster and RunSequential, which keeps them in the working
+// directory. Jobs submitted to a long-lived master get their own directory.
+func jobDir(jobId int) string {
+	if jobId == 0 {
+		return ""
+	}
+	return filepath.Join(JOBS_PATH, fmt.Sprintf("job-%v", jobId))
+}
+
 // Returns the name of files created after merge
 func mergeReduceName(idReduce int) string {
 	return fmt.Sprintf("reduce-%v", idReduce)
 }
 
+// Returns the name of the directory with the output of a map operation
+func mapOutputName(idMap int) string {
+	return fmt.Sprintf("map-%v", idMap)
+}
+
+// Returns the name of the file with a reduce partition in the output of a map operation
+func partitionName(idReduce int) string {
+	return fmt.Sprintf("partition-%v", idReduce)
+}
+
 // Returns the name of files created after map
 func reduceName(idMap int, idReduce int) string {
-	return fmt.Sprintf("reduce-%v-%v", idMap, idReduce)
+	return filepath.Join(mapOutputName(idMap), partitionName(idReduce))
+}
+
+// Returns the name of a scratch file an attempt writes to. Attempts of the same
+// operation can run at the same time when speculative execution is enabled, so each
+// one needs its own file.
+func attemptFileName(fileName string, attempt int) string {
+	return fmt.Sprintf("%v.attempt-%v", fileName, attempt)
 }
 
 // Store result from map operation locally.
-// This will store the result from all the map calls.
-func storeLocal(task *Task, idMapTask int, data []KeyValue) {
+// This will store the result from all the map calls. Pairs are split by reduce
+// partition and, if the task defines a Combine function, combined before being
+// written to the intermediate files. The files of every partition are committed
+// together once they're all written.
+func storeLocal(task *Task, jobDir string, idMapTask int, attempt int, data []KeyValue) error {
 	var (
-		err         error
-		file        *os.File
-		fileEncoder *json.Encoder
+		err        error
+		file       *os.File
+		fileWriter *bufio.Writer
+		pairs      pairWriter
+		partitions [][]KeyValue
+		committer  *outputCommitter
+		committed  bool
+		outputDir  string
+		written    int64
+		compressed int64
 	)
 
+	outputDir = filepath.Join(jobDir, REDUCE_PATH, mapOutputName(idMapTask))
+	if committer, err = newOutputCommitter(outputDir, attempt); err != nil {
+		return dataError("store map output", outputDir, err)
+	}
+
+	partitions = make([][]KeyValue, task.NumReduceJobs)
+	for _, kv := range data {
+		r := partition(task, kv.Key)
+		partitions[r] = append(partitions[r], kv)
+	}
+
 	for r := 0; r < task.NumReduceJobs; r++ {
-		file, err = os.Create(filepath.Join(REDUCE_PATH, reduceName(idMapTask, r)))
-		if err != nil {
-			log.Fatal(err)
+		if task.hasCombine() && len(partitions[r]) > 0 {
+			partitions[r] = task.combine(partitions[r])
+		}
+
+		if file, err = committer.create(partitionName(r)); err != nil {
+			committer.abort()
+			return dataError("store map output", outputDir, err)
 		}
 
-		fileEncoder = json.NewEncoder(file)
-		for _, kv := range data {
-			if task.Shuffle(task, kv.Key) == r {
-				err = fileEncoder.Encode(&kv)
-				if err != nil {
-					log.Fatal(err)
+		fileWriter = bufio.NewWriter(file)
+		if pairs, err = newPairWriter(fileWriter, task.Encoding, task.Compression); err == nil {
+			for _, kv := range partitions[r] {
+				if err = pairs.Write(kv); err != nil {
+					break
 				}
 			}
+
+			if err == nil {
+				err = pairs.Flush()
+			}
+			partitionWritten, partitionCompressed := pairs.sizes()
+			written += partitionWritten
+			compressed += partitionCompressed
+		}
+
+		if err == nil {
+			err = fileWriter.Flush()
+		}
+		if err == nil {
+			err = file.Sync()
 		}
-		file.Sync()
 		file.Close()
+
+		if err != nil {
+			committer.abort()
+			return dataError("store map output", file.Name(), err)
+		}
+	}
+
+	if committed, err = committer.commit(); err != nil {
+		committer.abort()
+		return dataError("commit map output", outputDir, err)
+	}
+
+	if !committed {
+		log.Printf("Discarding attempt %v of map %v, its output was already committed.\n", attempt, idMapTask)
 	}
+	logCompression(fmt.Sprintf("output of map %v", idMapTask), task.Compression, written, compressed)
+	return nil
 }
 
 // Merge the result from all the map operations by reduce job id.
-func mergeMapLocal(task *Task, mapCounter int) {
-	var (
-		err              error
-		file             *os.File
-		fileDecoder      *json.Decoder
-		mergeFile        *os.File
-		mergeFileEncoder *json.Encoder
-	)
-
+func mergeMapLocal(task *Task, jobDir string, mapCounter int) error {
 	for r := 0; r < task.NumReduceJobs; r++ {
-		if mergeFile, err = os.Create(filepath.Join(REDUCE_PATH, mergeReduceName(r))); err != nil {
-			log.Fatal(err)
+		if err := mergeMapPartition(task, jobDir, r, mapCounter); err != nil {
+			return err
 		}
+	}
+	return nil
+}
 
-		mergeFileEncoder = json.NewEncoder(mergeFile)
+// Merge the result of all the map operations for a single reduce job id.
+func mergeMapPartition(task *Task, jobDir string, idReduce int, mapCounter int) error {
+	fileNames := make([]string, mapCounter)
+	for m := range fileNames {
+		fileNames[m] = filepath.Join(jobDir, REDUCE_PATH, reduceName(m, idReduce))
+	}
 
-		for m := 0; m < mapCounter; m++ {
-			for i := 0; i < OPEN_FILE_MAX_RETRY; i++ {
-				if file, err = os.Open(filepath.Join(REDUCE_PATH, reduceName(m, r))); err == nil {
-					break
-				}
-				log.Printf("(%v/%v) Failed to open file %v. Retrying in 1 second...", i+1, OPEN_FILE_MAX_RETRY, filepath.Join(REDUCE_PATH, reduceName(m, r)))
-				time.Sleep(time.Second)
-			}
+	return mergeFiles(filepath.Join(jobDir, REDUCE_PATH, mergeReduceName(idReduce)), fileNames, intermediateFormat{task.Encoding, task.Compression})
+}
 
-			if err != nil {
-				log.Fatal(err)
-			}
+// Merge the result from all the reduce operations into the final result, written with
+// the output format of the task. Sorted by key when the task asks for it: results of
+// range partitions already are once concatenated.
+func mergeReduceLocal(task *Task, jobDir string, reduceCounter int) error {
+	fileNames := make([]string, reduceCounter)
+	for r := range fileNames {
+		fileNames[r] = resultFileName(jobDir, r)
+	}
 
-			if file, err = os.Open(filepath.Join(REDUCE_PATH, reduceName(m, r))); err != nil {
-				log.Fatal(err)
-			}
+	if task.SortedOutput && !isRangePartitioned(task) {
+		return mergeSorted(task, finalResultFileName(jobDir), fileNames, outputFormat(task))
+	}
+	return mergeFiles(finalResultFileName(jobDir), fileNames, outputFormat(task))
+}
 
-			fileDecoder = json.NewDecoder(file)
+// mergeFiles writes every pair of fileNames, in order, to mergeFileName with format.
+// It's only visible once every file is merged.
+func mergeFiles(mergeFileName string, fileNames []string, format OutputFormat) error {
+	return writeFile(mergeFileName, "merge", format, func(writer RecordWriter) error {
+		for _, fileName := range fileNames {
+			if err := decodeEach(fileName, writer.Write); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
 
-			for {
-				var kv KeyValue
-				err = fileDecoder.Decode(&kv)
-				if err != nil {
-					break
-				}
+// mergeSorted writes every pair of fileNames to mergeFileName with format, sorted by
+// key. Pairs with the same key keep the order of fileNames. Like reduce partitions,
+// what doesn't fit in the memory limit of the task is sorted on disk, next to
+// mergeFileName.
+func mergeSorted(task *Task, mergeFileName string, fileNames []string, format OutputFormat) error {
+	var (
+		err     error
+		file    *os.File
+		readers []pairReader
+		stream  *sortedStream
+	)
 
-				mergeFileEncoder.Encode(&kv)
-			}
-			file.Sync()
-			file.Close()
+	for _, fileName := range fileNames {
+		if file, err = os.Open(fileName); err != nil {
+			return dataError("open", fileName, err)
 		}
+		defer file.Close()
+		readers = append(readers, newPairReader(file))
+	}
 
-		mergeFile.Sync()
-		mergeFile.Close()
+	if stream, err = sortPartition(filepath.Dir(mergeFileName), filepath.Dir(mergeFileName), 0, &multiPairReader{readers: readers}, task.Encoding, reduceMemoryLimit(task)); err != nil {
+		return err
 	}
+	defer stream.close()
+
+	return writeFile(mergeFileName, "merge", format, func(writer RecordWriter) error {
+		for kv, ok := stream.next(); ok; kv, ok = stream.next() {
+			if err := writer.Write(kv); err != nil {
+				return err
+			}
+		}
+		return stream.err
+	})
 }
 
-// Merge the result from all the map operations by reduce job id.
-func mergeReduceLocal(reduceCounter int) {
+// decodeEach decodes every pair in fileName and passes it to f, stopping at the first
+// error. Data that can't be decoded is reported with corruptError.
+func decodeEach(fileName string, f func(KeyValue) error) error {
 	var (
-		err              error
-		file             *os.File
-		fileDecoder      *json.Decoder
-		mergeFile        *os.File
-		mergeFileEncoder *json.Encoder
+		err         error
+		file        *os.File
+		fileDecoder pairReader
 	)
 
-	if mergeFile, err = os.Create(filepath.Join(RESULT_PATH, "result-final.txt")); err != nil {
-		log.Fatal(err)
+	if file, err = os.Open(fileName); err != nil {
+		return dataError("open", fileName, err)
 	}
+	defer file.Close()
 
-	defer mergeFile.Sync()
-	defer mergeFile.Close()
+	fileDecoder = newPairReader(file)
 
-	mergeFileEncoder = json.NewEncoder(mergeFile)
-
-	for r := 0; r < reduceCounter; r++ {
-		for i := 0; i < OPEN_FILE_MAX_RETRY; i++ {
-			if file, err = os.Open(resultFileName(r)); err == nil {
-				break
-			}
-			log.Printf("(%v/%v) Failed to open file %v. Retrying in 1 second...", i+1, OPEN_FILE_MAX_RETRY, resultFileName(r))
-			time.Sleep(time.Second)
+	for {
+		var kv KeyValue
+		if err = fileDecoder.Decode(&kv); err == io.EOF {
+			return nil
 		}
-
 		if err != nil {
-			log.Fatal(err)
+			return corruptError(fileName, err)
 		}
 
-		fileDecoder = json.NewDecoder(file)
+		if err = f(kv); err != nil {
+			return dataError("write", fileName, err)
+		}
+	}
+}
 
-		for {
-			var kv KeyValue
-			err = fileDecoder.Decode(&kv)
-			if err != nil {
-				break
-			}
+// Load data for reduce jobs from the merged partition in fileName.
+func loadLocal(fileName string) (data []KeyValue, err error) {
+	data = make([]KeyValue, 0)
 
-			mergeFileEncoder.Encode(&kv)
-		}
-		file.Sync()
-		file.Close()
+	err = decodeEach(fileName, func(kv KeyValue) error {
+		data = append(data, kv)
+		return nil
+	})
+
+	if err != nil {
+		return nil, err
 	}
+	return data, nil
 }
 
-// Load data for reduce jobs.
-func loadLocal(idReduce int) (data []KeyValue) {
+// Load data for reduce jobs from the merged partition in fileName sorted by key.
+// Partitions bigger than the memory limit of the task are sorted on disk, next to
+// fileName. The returned stream must be closed by the caller.
+func loadSorted(task *Task, fileName string, idReduce int) (*sortedStream, error) {
 	var (
-		err         error
-		file        *os.File
-		fileDecoder *json.Decoder
+		err  error
+		file *os.File
 	)
 
-	if file, err = os.Open(filepath.Join(REDUCE_PATH, mergeReduceName(idReduce))); err != nil {
-		log.Fatal(err)
+	if file, err = os.Open(fileName); err != nil {
+		return nil, dataError("open", fileName, err)
 	}
+	defer file.Close()
 
-	fileDecoder = json.NewDecoder(file)
+	return sortPartition(fileName, filepath.Dir(fileName), idReduce, newPairReader(file), task.Encoding, reduceMemoryLimit(task))
+}
 
-	data = make([]KeyValue, 0)
+// Run the reduce function of the task over a reduce partition and return its result.
+// Uses the per-key ReduceByKey when the task defines one.
+func reduceLocal(task *Task, jobDir string, idReduce int) (result []KeyValue, err error) {
+	result = make([]KeyValue, 0)
 
-	for {
-		var kv KeyValue
-		if err = fileDecoder.Decode(&kv); err != nil {
-			break
+	err = reduceStream(task, filepath.Join(jobDir, REDUCE_PATH, mergeReduceName(idReduce)), idReduce, func(kv KeyValue) {
+		result = append(result, kv)
+	})
+
+	if err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+// Run the reduce function of the task over the merged partition in fileName and pass
+// every result to emit. With ReduceByKey neither the partition nor the result are
+// fully held in memory.
+func reduceStream(task *Task, fileName string, idReduce int, emit func(KeyValue)) error {
+	if !task.hasReduceByKey() {
+		data, err := loadLocal(fileName)
+		if err != nil {
+			return err
 		}
 
-		data = append(data, kv)
+		if size := partitionSize(data); size > reduceMemoryLimit(task) {
+			log.Printf("Reduce partition %v holds %v bytes, above the limit of %v bytes. Use ReduceByKey to stream it.\n", idReduce, size, reduceMemoryLimit(task))
+		}
+
+		result := task.reduce(data)
+		if isRangePartitioned(task) {
+			// Results of range partitions are sorted by key, like the ones of
+			// ReduceByKey, so they're in order once concatenated
+			sortByKey(result)
+		}
+
+		for _, kv := range result {
+			emit(kv)
+		}
+		return nil
+	}
+
+	stream, err := loadSorted(task, fileName, idReduce)
+	if err != nil {
+		return err
 	}
+	defer stream.close()
+
+	reduceSorted(task, stream, emit)
+	return stream.err
+}
 
-	file.Close()
-	return data
+// Returns the estimated memory held by data
+func partitionSize(data []KeyValue) (size int) {
+	for _, kv := range data {
+		size += keyValueSize(kv)
+	}
+	return size
 }
 
 func RemoveContents(dir string) error {
@@ -208,7 +362,7 @@ func RemoveContents(dir string) error {
 // FanIn is a pattern that will return a channel in which the goroutines generated here will keep
 // writing until the loop is done.
 // This is used to generate the name of all the reduce files.
-func fanReduceFilePath(numReduceJobs int) chan string {
+func fanReduceFilePath(jobDir string, numReduceJobs int) chan string {
 	var (
 		outputChan chan string
 		filePath   string
@@ -218,7 +372,7 @@ func fanReduceFilePath(numReduceJobs int) chan string {
 
 	go func() {
 		for i := 0; i < numReduceJobs; i++ {
-			filePath = filepath.Join(REDUCE_PATH, mergeReduceName(i))
+			filePath = filepath.Join(jobDir, REDUCE_PATH, mergeReduceName(i))
 
 			outputChan <- filePath
 		}
@@ -228,7 +382,37 @@ func fanReduceFilePath(numReduceJobs int) chan string {
 	return outputChan
 }
 
+// fanFilePath returns a channel that yields filePaths in order and is then closed.
+func fanFilePath(filePaths []string) chan string {
+	var outputChan chan string
+
+	outputChan = make(chan string)
+
+	go func() {
+		for _, filePath := range filePaths {
+			outputChan <- filePath
+		}
+
+		close(outputChan)
+	}()
+	return outputChan
+}
+
+// collectFilePaths reads every file path from filePathChan until it's closed.
+func collectFilePaths(filePathChan chan string) (filePaths []string) {
+	filePaths = make([]string, 0)
+	for filePath := range filePathChan {
+		filePaths = append(filePaths, filePath)
+	}
+	return filePaths
+}
+
+// Returns the name of the file with the merged result of every reduce operation.
+func finalResultFileName(jobDir string) string {
+	return filepath.Join(jobDir, RESULT_PATH, "result-final.txt")
+}
+
 // Support function to generate the name of result files
-func resultFileName(id int) string {
-	return filepath.Join(RESULT_PATH, fmt.Sprintf("result-%v", id))
+func resultFileName(jobDir string, id int) string {
+	return filepath.Join(jobDir, RESULT_PATH, fmt.Sprintf("result-%v", id))
 }
@@ -0,0 +1,128 @@
+package mapreduce
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"io"
+)
+
+// Intermediate files, map outputs, merged partitions, results of reduce operations and
+// sorted runs spilled to disk, hold pairs encoded with the Encoding of their job:
+//
+//	ENCODING_JSON     one JSON document per pair, compressed as a whole, see compress.go
+//	ENCODING_BINARY   length-prefixed records in blocks with a CRC, see binary.go
+//
+// Readers tell the encoding of a file from its first bytes. The encoding is set per
+// job and sent to the workers with every operation, so the outputs of every map
+// operation a reducer fetches into a single file have the same one.
+
+type Encoding string
+
+const (
+	ENCODING_JSON   Encoding = ""
+	ENCODING_BINARY Encoding = "binary"
+)
+
+// pairWriter writes the pairs of an intermediate file. Flush must be called once every
+// pair is written, it doesn't flush or close the underlying writer.
+type pairWriter interface {
+	RecordWriter
+
+	// sizes returns the bytes of the encoded pairs and of what was written to the
+	// underlying writer, once compressed.
+	sizes() (written int64, compressed int64)
+}
+
+// pairReader reads the pairs of an intermediate file.
+type pairReader interface {
+	// Decode reads the next pair into kv, or returns io.EOF after the last one.
+	Decode(kv *KeyValue) error
+}
+
+// newPairWriter returns a writer of pairs to w with encoding and compression.
+func newPairWriter(w io.Writer, encoding Encoding, compression Compression) (pairWriter, error) {
+	switch encoding {
+	case ENCODING_JSON:
+		compressor, err := newCompressWriter(w, compression)
+		if err != nil {
+			return nil, err
+		}
+		return &jsonPairWriter{compressor: compressor, encoder: json.NewEncoder(compressor)}, nil
+	case ENCODING_BINARY:
+		return newBinaryWriter(w, compression)
+	}
+	return nil, unknownSettingError("encode", "encoding", encoding)
+}
+
+// newPairReader returns a reader of the pairs in r, whatever their encoding.
+func newPairReader(r io.Reader) pairReader {
+	source := bufio.NewReader(r)
+
+	if header, _ := source.Peek(len(BINARY_SYNC)); bytes.Equal(header, []byte(BINARY_SYNC)) {
+		return newBinaryReader(source)
+	}
+	return jsonPairReader{json.NewDecoder(newDecompressReader(source))}
+}
+
+type jsonPairWriter struct {
+	compressor *compressWriter
+	encoder    *json.Encoder
+}
+
+func (writer *jsonPairWriter) Write(kv KeyValue) error {
+	return writer.encoder.Encode(&kv)
+}
+
+func (writer *jsonPairWriter) Flush() error {
+	return writer.compressor.Close()
+}
+
+func (writer *jsonPairWriter) sizes() (int64, int64) {
+	return writer.compressor.written, writer.compressor.output.count
+}
+
+type jsonPairReader struct {
+	decoder *json.Decoder
+}
+
+func (reader jsonPairReader) Decode(kv *KeyValue) error {
+	return reader.decoder.Decode(kv)
+}
+
+// multiPairReader reads the pairs of readers one after the other.
+type multiPairReader struct {
+	readers []pairReader
+}
+
+func (reader *multiPairReader) Decode(kv *KeyValue) error {
+	for len(reader.readers) > 0 {
+		if err := reader.readers[0].Decode(kv); err != io.EOF {
+			return err
+		}
+		reader.readers = reader.readers[1:]
+	}
+	return io.EOF
+}
+
+// intermediateFormat is the OutputFormat of intermediate files written by writeFile.
+type intermediateFormat struct {
+	encoding    Encoding
+	compression Compression
+}
+
+func (format intermediateFormat) NewWriter(w io.Writer) RecordWriter {
+	writer, err := newPairWriter(w, format.encoding, format.compression)
+	if err != nil {
+		return failedWriter{err}
+	}
+	return writer
+}
+
+// failedWriter returns the error that kept it from being created on every call.
+type failedWriter struct {
+	err error
+}
+
+func (writer failedWriter) Write(KeyValue) error { return writer.err }
+func (writer failedWriter) Flush() error         { return writer.err }
@@ -0,0 +1,91 @@
+package mapreduce
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"testing"
+)
+
+// Benchmarks of the encodings of intermediate files, with pairs like the ones of
+// wordcount. Run with:
+//
+//	go test -bench . -benchmem ./mapreduce
+
+const BENCHMARK_PAIRS = 100000
+
+func benchmarkPairs() []KeyValue {
+	pairs := make([]KeyValue, BENCHMARK_PAIRS)
+	for i := range pairs {
+		pairs[i] = KeyValue{Key: fmt.Sprintf("word%v", i%5000), Value: "1"}
+	}
+	return pairs
+}
+
+// encodePairs writes pairs to buffer with encoding and compression.
+func encodePairs(tb testing.TB, buffer *bytes.Buffer, pairs []KeyValue, encoding Encoding, compression Compression) {
+	writer, err := newPairWriter(buffer, encoding, compression)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	for _, kv := range pairs {
+		if err = writer.Write(kv); err != nil {
+			tb.Fatal(err)
+		}
+	}
+	if err = writer.Flush(); err != nil {
+		tb.Fatal(err)
+	}
+}
+
+func benchmarkEncode(b *testing.B, encoding Encoding, compression Compression) {
+	var buffer bytes.Buffer
+
+	pairs := benchmarkPairs()
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		buffer.Reset()
+		encodePairs(b, &buffer, pairs, encoding, compression)
+	}
+	b.ReportMetric(float64(buffer.Len())/BENCHMARK_PAIRS, "bytes/pair")
+}
+
+func benchmarkDecode(b *testing.B, encoding Encoding, compression Compression) {
+	var (
+		buffer bytes.Buffer
+		kv     KeyValue
+	)
+
+	encodePairs(b, &buffer, benchmarkPairs(), encoding, compression)
+	b.SetBytes(int64(buffer.Len()))
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		reader := newPairReader(bytes.NewReader(buffer.Bytes()))
+
+		decoded := 0
+		for {
+			err := reader.Decode(&kv)
+			if err == io.EOF {
+				break
+			} else if err != nil {
+				b.Fatal(err)
+			}
+			decoded++
+		}
+		if decoded != BENCHMARK_PAIRS {
+			b.Fatalf("decoded %v pairs, want %v", decoded, BENCHMARK_PAIRS)
+		}
+	}
+}
+
+func BenchmarkEncodeJSON(b *testing.B)       { benchmarkEncode(b, ENCODING_JSON, COMPRESSION_NONE) }
+func BenchmarkEncodeBinary(b *testing.B)     { benchmarkEncode(b, ENCODING_BINARY, COMPRESSION_NONE) }
+func BenchmarkEncodeJSONGzip(b *testing.B)   { benchmarkEncode(b, ENCODING_JSON, COMPRESSION_GZIP) }
+func BenchmarkEncodeBinaryGzip(b *testing.B) { benchmarkEncode(b, ENCODING_BINARY, COMPRESSION_GZIP) }
+
+func BenchmarkDecodeJSON(b *testing.B)       { benchmarkDecode(b, ENCODING_JSON, COMPRESSION_NONE) }
+func BenchmarkDecodeBinary(b *testing.B)     { benchmarkDecode(b, ENCODING_BINARY, COMPRESSION_NONE) }
+func BenchmarkDecodeJSONGzip(b *testing.B)   { benchmarkDecode(b, ENCODING_JSON, COMPRESSION_GZIP) }
+func BenchmarkDecodeBinaryGzip(b *testing.B) { benchmarkDecode(b, ENCODING_BINARY, COMPRESSION_GZIP) }
@@ -0,0 +1,95 @@
+package mapreduce
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"net/rpc"
+	"os"
+	"strings"
+)
+
+const (
+	// Errors returned by workers only reach the master as text, fatal ones are marked
+	// with this prefix.
+	FATAL_ERROR_PREFIX = "fatal: "
+)
+
+// ErrCorrupt is wrapped by the errors of data that can't be decoded.
+var ErrCorrupt = errors.New("corrupt data")
+
+// DataError is an error of the data layer: reading, writing or committing the files
+// of an operation. Fatal errors can't be fixed by running the operation again, like a
+// missing input file or a record of the input that can't be parsed, and abort the job.
+// Any other is retried.
+type DataError struct {
+	Op    string // what was being done, like "read input"
+	Path  string
+	Err   error
+	Fatal bool
+}
+
+func (err *DataError) Error() string {
+	var pathErr *fs.PathError
+
+	message := fmt.Sprintf("%v %v: %v", err.Op, err.Path, err.Err)
+	if errors.As(err.Err, &pathErr) {
+		// The path is already in the message of Err
+		message = fmt.Sprintf("%v: %v", err.Op, err.Err)
+	}
+	if err.Fatal {
+		return FATAL_ERROR_PREFIX + message
+	}
+	return message
+}
+
+func (err *DataError) Unwrap() error {
+	return err.Err
+}
+
+// dataError wraps err, if any, into a retryable DataError. Errors that are already a
+// DataError are kept as they are.
+func dataError(op string, path string, err error) error {
+	var dataErr *DataError
+
+	if err == nil || errors.As(err, &dataErr) {
+		return err
+	}
+	return &DataError{Op: op, Path: path, Err: err}
+}
+
+// inputError wraps an error reading the input of a job. The input isn't produced by
+// any operation, so if it's missing or corrupt running again won't help.
+func inputError(path string, err error) error {
+	if err == nil {
+		return nil
+	}
+	return &DataError{Op: "read input", Path: path, Err: err, Fatal: os.IsNotExist(err) || errors.Is(err, ErrCorrupt)}
+}
+
+// corruptError returns the error of intermediate data in path that couldn't be
+// decoded. It was written or fetched by an operation, so running it again fixes it.
+func corruptError(path string, err error) error {
+	if !errors.Is(err, ErrCorrupt) {
+		err = fmt.Errorf("%w: %v", ErrCorrupt, err)
+	}
+	return &DataError{Op: "decode", Path: path, Err: err}
+}
+
+// isFatalError returns true if err means the operation fails whenever it's run, either
+// because it's a fatal DataError or because a worker returned one through RPC.
+func isFatalError(err error) bool {
+	var (
+		dataErr   *DataError
+		serverErr rpc.ServerError
+	)
+
+	if errors.As(err, &dataErr) {
+		return dataErr.Fatal
+	}
+
+	if errors.As(err, &serverErr) {
+		return strings.HasPrefix(string(serverErr), FATAL_ERROR_PREFIX)
+	}
+	return false
+}
@@ -0,0 +1,375 @@
+package mapreduce
+
+import (
+	"bufio"
+	"context"
+	"encoding/gob"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math/rand"
+	"net/rpc"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Faults are injected into the operations run by a worker following a FaultSpec, so
+// failure scenarios can be reproduced. A spec is a list of rules, for instance:
+//
+//	{
+//	  "seed": 42,
+//	  "faults": [
+//	    {"proc": "map", "point": "during", "action": "crash", "nth": 3},
+//	    {"proc": "reduce", "action": "delay", "delay": "2s", "probability": 0.5},
+//	    {"action": "drop-reply", "nth": 5}
+//	  ]
+//	}
+//
+// Every operation received by the worker is matched against every rule, in order. A
+// rule fires on the operation if it is the nth one the rule matched (any operation
+// when nth is 0), the seeded random draw is below probability (always when 0) and it
+// hasn't fired times times already (no limit when 0). With the same seed and the same
+// operations, the same faults are injected.
+
+type FaultPoint string
+
+// Where in an operation a fault is injected
+const (
+	FAULT_BEFORE FaultPoint = "before" // before reading the input
+	FAULT_DURING FaultPoint = "during" // after computing the output, before committing it
+	FAULT_AFTER  FaultPoint = "after"  // after committing the output, before replying
+)
+
+type FaultAction string
+
+const (
+	FAULT_CRASH      FaultAction = "crash"      // the worker process dies
+	FAULT_DELAY      FaultAction = "delay"      // the operation sleeps for Delay
+	FAULT_HANG       FaultAction = "hang"       // the operation never returns, cancels included
+	FAULT_ERROR      FaultAction = "error"      // the operation returns an error
+	FAULT_DROP_REPLY FaultAction = "drop-reply" // the operation runs but its reply is never sent
+	FAULT_CORRUPT    FaultAction = "corrupt"    // the committed output is corrupted
+)
+
+// FaultRule describes a fault and the operations it's injected into. Drop-reply and
+// corrupt faults happen after the output is committed, their point is ignored.
+type FaultRule struct {
+	Proc        string      `json:"proc"`  // map, reduce or empty for both
+	Point       FaultPoint  `json:"point"` // before when empty
+	Action      FaultAction `json:"action"`
+	Nth         int         `json:"nth"`
+	Probability float64     `json:"probability"`
+	Times       int         `json:"times"`
+	Delay       string      `json:"delay"` // duration of delay faults, like "1.5s"
+
+	delay time.Duration
+}
+
+// FaultSpec is the set of faults injected by a worker. A seed of 0 is replaced by a
+// random one, which is logged so the run can be reproduced.
+type FaultSpec struct {
+	Seed   int64       `json:"seed"`
+	Faults []FaultRule `json:"faults"`
+}
+
+// LoadFaultSpec reads a FaultSpec from arg, which is either the spec itself in JSON
+// or the name of a file with it.
+func LoadFaultSpec(arg string) (spec *FaultSpec, err error) {
+	var data []byte
+
+	if strings.HasPrefix(strings.TrimSpace(arg), "{") {
+		data = []byte(arg)
+	} else if data, err = os.ReadFile(arg); err != nil {
+		return nil, err
+	}
+
+	spec = new(FaultSpec)
+	if err = json.Unmarshal(data, spec); err != nil {
+		return nil, fmt.Errorf("parsing fault spec: %v", err)
+	}
+	return spec, nil
+}
+
+// validate checks every rule of the spec and fills in their defaults.
+func (spec *FaultSpec) validate() error {
+	var err error
+
+	for i := range spec.Faults {
+		rule := &spec.Faults[i]
+
+		switch rule.Proc {
+		case "", "map", "reduce":
+		default:
+			return fmt.Errorf("fault %v: unknown proc '%v'", i, rule.Proc)
+		}
+
+		switch rule.Point {
+		case "":
+			rule.Point = FAULT_BEFORE
+		case FAULT_BEFORE, FAULT_DURING, FAULT_AFTER:
+		default:
+			return fmt.Errorf("fault %v: unknown point '%v'", i, rule.Point)
+		}
+
+		switch rule.Action {
+		case FAULT_CRASH, FAULT_HANG, FAULT_ERROR, FAULT_DROP_REPLY, FAULT_CORRUPT:
+		case FAULT_DELAY:
+			if rule.delay, err = time.ParseDuration(rule.Delay); err != nil {
+				return fmt.Errorf("fault %v: %v", i, err)
+			}
+		default:
+			return fmt.Errorf("fault %v: unknown action '%v'", i, rule.Action)
+		}
+
+		if rule.Probability < 0 || rule.Probability > 1 {
+			return fmt.Errorf("fault %v: probability must be between 0 and 1", i)
+		}
+	}
+	return nil
+}
+
+// faultInjector decides which faults are injected into every operation of a worker.
+type faultInjector struct {
+	mutex   sync.Mutex
+	rules   []FaultRule
+	matched []int // operations matched by every rule
+	fired   []int // times every rule fired
+	random  *rand.Rand
+
+	// Faults of the operations received but not started yet, by operationKey
+	pending map[string][]FaultRule
+}
+
+// newFaultInjector returns the injector of spec, or nil if it has no faults.
+func newFaultInjector(spec *FaultSpec) (*faultInjector, error) {
+	if spec == nil || len(spec.Faults) == 0 {
+		return nil, nil
+	}
+
+	if err := spec.validate(); err != nil {
+		return nil, err
+	}
+
+	seed := spec.Seed
+	if seed == 0 {
+		seed = time.Now().UnixNano()
+	}
+	log.Printf("Injecting %v faults with seed %v\n", len(spec.Faults), seed)
+
+	return &faultInjector{
+		rules:   spec.Faults,
+		matched: make([]int, len(spec.Faults)),
+		fired:   make([]int, len(spec.Faults)),
+		random:  rand.New(rand.NewSource(seed)),
+		pending: make(map[string][]FaultRule),
+	}, nil
+}
+
+// prepare decides the faults of the operation described by proc and args when its
+// request is received. They're picked up by the operation with take.
+func (injector *faultInjector) prepare(proc string, args *RunArgs) []FaultRule {
+	var faults []FaultRule
+
+	injector.mutex.Lock()
+	defer injector.mutex.Unlock()
+
+	for i, rule := range injector.rules {
+		if rule.Proc != "" && rule.Proc != phaseName(proc) {
+			continue
+		}
+
+		injector.matched[i]++
+		if rule.Nth > 0 && injector.matched[i] != rule.Nth {
+			continue
+		}
+		if rule.Times > 0 && injector.fired[i] >= rule.Times {
+			continue
+		}
+		if rule.Probability > 0 && injector.random.Float64() >= rule.Probability {
+			continue
+		}
+
+		injector.fired[i]++
+		faults = append(faults, rule)
+	}
+
+	injector.pending[operationKey(args.JobId, proc, args.Id, args.Attempt)] = faults
+	return faults
+}
+
+// take returns the faults decided for an operation when its request was received.
+func (injector *faultInjector) take(proc string, args *RunArgs) []FaultRule {
+	if injector == nil {
+		return nil
+	}
+
+	injector.mutex.Lock()
+	defer injector.mutex.Unlock()
+
+	key := operationKey(args.JobId, proc, args.Id, args.Attempt)
+	faults := injector.pending[key]
+	delete(injector.pending, key)
+	return faults
+}
+
+// injectFaults injects the faults that happen at point of an operation. Staged is
+// called before crashing during an operation, to leave its partial output behind.
+// Returns the error the operation must return, if any.
+func injectFaults(ctx context.Context, faults []FaultRule, point FaultPoint, staged func()) error {
+	for _, fault := range faults {
+		if fault.Point != point {
+			continue
+		}
+
+		switch fault.Action {
+		case FAULT_CRASH:
+			log.Printf("Induced failure %v operation.\n", point)
+			if point == FAULT_DURING && staged != nil {
+				staged()
+			}
+			// Allow descriptors to be closed.
+			time.Sleep(time.Duration(100) * time.Millisecond)
+			panic("Induced failure.")
+
+		case FAULT_DELAY:
+			log.Printf("Induced slowness. Sleeping for %v\n", fault.delay)
+			select {
+			case <-time.After(fault.delay):
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+
+		case FAULT_HANG:
+			log.Printf("Induced hang %v operation.\n", point)
+			select {}
+
+		case FAULT_ERROR:
+			log.Printf("Induced error %v operation.\n", point)
+			return errors.New("induced error")
+		}
+	}
+	return nil
+}
+
+// hasFault returns true if action is one of faults.
+func hasFault(faults []FaultRule, action FaultAction) bool {
+	for _, fault := range faults {
+		if fault.Action == action {
+			return true
+		}
+	}
+	return false
+}
+
+// corruptFiles overwrites the middle of every file in dir when faults has a corrupt
+// fault, so readers find garbage instead of the committed output.
+func corruptFiles(faults []FaultRule, dir string) {
+	if !hasFault(faults, FAULT_CORRUPT) {
+		return
+	}
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		log.Println("Failed to corrupt output. Error:", err)
+		return
+	}
+
+	for _, entry := range entries {
+		fileName := filepath.Join(dir, entry.Name())
+		info, err := entry.Info()
+		if err != nil || info.Size() == 0 {
+			continue
+		}
+
+		file, err := os.OpenFile(fileName, os.O_WRONLY, 0)
+		if err != nil {
+			log.Println("Failed to corrupt output. Error:", err)
+			continue
+		}
+		file.WriteAt([]byte("\x00#corrupted#\x00"), info.Size()/2)
+		file.Close()
+		log.Printf("Induced corruption of %v\n", fileName)
+	}
+}
+
+// faultCodec serves RPCs like the gob codec of net/rpc, except that the faults of
+// RunMap and RunReduce requests are decided as they're read and their reply is dropped
+// if they got a drop-reply fault.
+type faultCodec struct {
+	rwc      io.ReadWriteCloser
+	dec      *gob.Decoder
+	enc      *gob.Encoder
+	encBuf   *bufio.Writer
+	injector *faultInjector
+
+	// Requests are read one at a time, replies are written concurrently
+	request *rpc.Request
+	mutex   sync.Mutex
+	dropped map[uint64]bool
+}
+
+func newFaultCodec(conn io.ReadWriteCloser, injector *faultInjector) *faultCodec {
+	buf := bufio.NewWriter(conn)
+	return &faultCodec{
+		rwc:      conn,
+		dec:      gob.NewDecoder(conn),
+		enc:      gob.NewEncoder(buf),
+		encBuf:   buf,
+		injector: injector,
+		dropped:  make(map[uint64]bool),
+	}
+}
+
+func (codec *faultCodec) ReadRequestHeader(request *rpc.Request) error {
+	codec.request = request
+	return codec.dec.Decode(request)
+}
+
+func (codec *faultCodec) ReadRequestBody(body interface{}) error {
+	if err := codec.dec.Decode(body); err != nil {
+		return err
+	}
+
+	// Other RPCs taking RunArgs, like SampleMap, never take their faults
+	method := codec.request.ServiceMethod
+	if args, ok := body.(*RunArgs); ok && (method == "Worker.RunMap" || method == "Worker.RunReduce") {
+		faults := codec.injector.prepare(method, args)
+		if hasFault(faults, FAULT_DROP_REPLY) {
+			codec.mutex.Lock()
+			codec.dropped[codec.request.Seq] = true
+			codec.mutex.Unlock()
+		}
+	}
+	return nil
+}
+
+func (codec *faultCodec) WriteResponse(response *rpc.Response, body interface{}) (err error) {
+	codec.mutex.Lock()
+	dropped := codec.dropped[response.Seq]
+	delete(codec.dropped, response.Seq)
+	codec.mutex.Unlock()
+
+	if dropped {
+		log.Printf("Induced drop of reply to %v\n", response.ServiceMethod)
+		return nil
+	}
+
+	if err = codec.enc.Encode(response); err != nil {
+		codec.Close()
+		return err
+	}
+	if err = codec.enc.Encode(body); err != nil {
+		codec.Close()
+		return err
+	}
+	return codec.encBuf.Flush()
+}
+
+func (codec *faultCodec) Close() error {
+	return codec.rwc.Close()
+}
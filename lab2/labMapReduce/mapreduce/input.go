@@ -0,0 +1,442 @@
+package mapreduce
+
+import (
+	"bufio"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// An InputFormat cuts the input of a job into splits, one per map operation, and reads
+// the records of a split. Map operations of a task with an InputFormat call MapRecord
+// once per record instead of Map once per chunk.
+//
+// Splits reach the workers as the file path of their map operation. A split of a
+// whole file is just its path, a byte range is encoded as "path#offset+length".
+//
+// Formats shipped with the package:
+//
+//	TextInputFormat        one record per line, split by byte ranges
+//	JSONLinesInputFormat   one JSON document per line, split by byte ranges
+//	CSVInputFormat         one record per CSV row, one split per file
+//	BinaryInputFormat      one pair per record of ENCODING_BINARY files, split by byte ranges
+//	DirInputFormat         every file of a directory, read with another format
+
+const (
+	INPUT_SPLIT_SEPARATOR = "#"
+)
+
+// InputSplit is the part of the input read by a map operation: Length bytes of the
+// file at Path, starting at Offset. A Length of 0 reads to the end of the file.
+type InputSplit struct {
+	Path   string
+	Offset int64
+	Length int64
+}
+
+// Record is a record of the input, passed to Task.MapRecord.
+type Record struct {
+	Path   string   // file the record was read from
+	Offset int64    // position of the record in the file, in bytes
+	Key    string   // key of the pair of binary records, empty for the others
+	Value  string   // the line without its line break, the CSV fields joined by the separator, or the value of the pair
+	Fields []string // fields of CSV records, nil for the others
+}
+
+type InputFormat interface {
+	// Splits returns the splits of the input at path, of about splitSize bytes each.
+	Splits(path string, splitSize int64) ([]InputSplit, error)
+
+	// Open returns a reader of the records of split.
+	Open(split InputSplit) (RecordReader, error)
+
+	// Name identifies the format and the settings it reads records with. It's the same
+	// in every process, so workers check they read the input of a job with the format
+	// it was split with by comparing names.
+	Name() string
+}
+
+type RecordReader interface {
+	// Next returns the next record of the split, or io.EOF after the last one. Records
+	// that can't be parsed return an error wrapping ErrCorrupt.
+	Next() (Record, error)
+	Close() error
+}
+
+// String encodes split as the file path of a map operation.
+func (split InputSplit) String() string {
+	if split.Offset == 0 && split.Length == 0 {
+		return split.Path
+	}
+	return fmt.Sprintf("%v%v%v+%v", split.Path, INPUT_SPLIT_SEPARATOR, split.Offset, split.Length)
+}
+
+// ParseInputSplit decodes the file path of a map operation into its split. Paths that
+// don't encode a byte range are a split of the whole file.
+func ParseInputSplit(filePath string) InputSplit {
+	if i := strings.LastIndex(filePath, INPUT_SPLIT_SEPARATOR); i >= 0 {
+		offset, length, found := strings.Cut(filePath[i+len(INPUT_SPLIT_SEPARATOR):], "+")
+		if found {
+			o, errOffset := strconv.ParseInt(offset, 10, 64)
+			l, errLength := strconv.ParseInt(length, 10, 64)
+			if errOffset == nil && errLength == nil {
+				return InputSplit{Path: filePath[:i], Offset: o, Length: l}
+			}
+		}
+	}
+	return InputSplit{Path: filePath}
+}
+
+// SplitInput cuts the input at path with format and returns the file paths of the map
+// operations that read it, to be sent through Task.InputFilePathChan or SubmitJob.
+func SplitInput(format InputFormat, path string, splitSize int64) ([]string, error) {
+	splits, err := format.Splits(path, splitSize)
+	if err != nil {
+		return nil, err
+	}
+
+	filePaths := make([]string, 0, len(splits))
+	for _, split := range splits {
+		filePaths = append(filePaths, split.String())
+	}
+	return filePaths, nil
+}
+
+// inputFormatName returns the name of format, empty for the chunks read by Task.Map.
+func inputFormatName(format InputFormat) string {
+	if format == nil {
+		return ""
+	}
+	return format.Name()
+}
+
+// mapSplit calls task.MapRecord on every record of the split encoded in filePath.
+// Returns the pairs emitted and the bytes of records read.
+func mapSplit(task *Task, filePath string) (result []KeyValue, bytesRead int, err error) {
+	var (
+		split  InputSplit
+		reader RecordReader
+		record Record
+	)
+
+	split = ParseInputSplit(filePath)
+	if reader, err = task.InputFormat.Open(split); err != nil {
+		return nil, 0, inputError(split.Path, err)
+	}
+	defer reader.Close()
+
+	result = make([]KeyValue, 0)
+	for {
+		if record, err = reader.Next(); err == io.EOF {
+			return result, bytesRead, nil
+		} else if err != nil {
+			return nil, bytesRead, inputError(filePath, err)
+		}
+
+		bytesRead += len(record.Value)
+		result = append(result, task.mapRecord(record)...)
+	}
+}
+
+// byteRangeSplits cuts the file at path into byte ranges of splitSize. Files no bigger
+// than splitSize are a single split.
+func byteRangeSplits(path string, splitSize int64) ([]InputSplit, error) {
+	var splits []InputSplit
+
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+
+	if splitSize <= 0 || info.Size() <= splitSize {
+		return []InputSplit{{Path: path}}, nil
+	}
+
+	for offset := int64(0); offset < info.Size(); offset += splitSize {
+		splits = append(splits, InputSplit{Path: path, Offset: offset, Length: min(splitSize, info.Size()-offset)})
+	}
+	return splits, nil
+}
+
+// lineReader reads the lines of a split. A line belongs to the split it starts in, so
+// a split skips the line cut by its start and finishes the one cut by its end.
+type lineReader struct {
+	file   *os.File
+	reader *bufio.Reader
+	pos    int64 // offset of the next line
+	end    int64 // lines starting here or after belong to the next split, -1 for none
+}
+
+func openLines(split InputSplit) (*lineReader, error) {
+	var (
+		err   error
+		lines *lineReader
+		start int64
+	)
+
+	lines = &lineReader{end: -1}
+	if split.Length > 0 {
+		lines.end = split.Offset + split.Length
+	}
+
+	if lines.file, err = os.Open(split.Path); err != nil {
+		return nil, err
+	}
+
+	// Starting one byte early tells if the split starts at the beginning of a line: the
+	// skipped line is then just the line break of the previous one.
+	if start = split.Offset; start > 0 {
+		start--
+	}
+
+	if _, err = lines.file.Seek(start, io.SeekStart); err != nil {
+		lines.file.Close()
+		return nil, err
+	}
+	lines.reader = bufio.NewReader(lines.file)
+	lines.pos = start
+
+	if split.Offset > 0 {
+		if _, err = lines.readLine(); err != nil && err != io.EOF {
+			lines.file.Close()
+			return nil, err
+		}
+	}
+	return lines, nil
+}
+
+// next returns the next line of the split and its offset.
+func (lines *lineReader) next() (string, int64, error) {
+	if lines.end >= 0 && lines.pos >= lines.end {
+		return "", 0, io.EOF
+	}
+
+	offset := lines.pos
+	line, err := lines.readLine()
+	return line, offset, err
+}
+
+// readLine returns the next line without its line break. The last line of the file
+// doesn't need one.
+func (lines *lineReader) readLine() (string, error) {
+	line, err := lines.reader.ReadString('\n')
+	lines.pos += int64(len(line))
+
+	if err == io.EOF && len(line) > 0 {
+		err = nil
+	}
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSuffix(strings.TrimSuffix(line, "\n"), "\r"), nil
+}
+
+func (lines *lineReader) Close() error {
+	return lines.file.Close()
+}
+
+// TextInputFormat reads text files, one record per line.
+type TextInputFormat struct{}
+
+func (TextInputFormat) Splits(path string, splitSize int64) ([]InputSplit, error) {
+	return byteRangeSplits(path, splitSize)
+}
+
+func (TextInputFormat) Name() string {
+	return "text"
+}
+
+func (TextInputFormat) Open(split InputSplit) (RecordReader, error) {
+	lines, err := openLines(split)
+	if err != nil {
+		return nil, err
+	}
+	return &textReader{lineReader: lines, path: split.Path}, nil
+}
+
+type textReader struct {
+	*lineReader
+	path string
+}
+
+func (reader *textReader) Next() (Record, error) {
+	line, offset, err := reader.next()
+	if err != nil {
+		return Record{}, err
+	}
+	return Record{Path: reader.path, Offset: offset, Value: line}, nil
+}
+
+// JSONLinesInputFormat reads JSON Lines files, one JSON document per line. Blank lines
+// are skipped. The Value of a record is the document, for MapRecord to decode.
+type JSONLinesInputFormat struct{}
+
+func (JSONLinesInputFormat) Splits(path string, splitSize int64) ([]InputSplit, error) {
+	return byteRangeSplits(path, splitSize)
+}
+
+func (JSONLinesInputFormat) Name() string {
+	return "jsonl"
+}
+
+func (JSONLinesInputFormat) Open(split InputSplit) (RecordReader, error) {
+	lines, err := openLines(split)
+	if err != nil {
+		return nil, err
+	}
+	return &jsonLinesReader{lineReader: lines, path: split.Path}, nil
+}
+
+type jsonLinesReader struct {
+	*lineReader
+	path string
+}
+
+func (reader *jsonLinesReader) Next() (Record, error) {
+	for {
+		line, offset, err := reader.next()
+		if err != nil {
+			return Record{}, err
+		}
+
+		if strings.TrimSpace(line) == "" {
+			continue
+		}
+		if !json.Valid([]byte(line)) {
+			return Record{}, fmt.Errorf("%w: line at offset %v isn't valid JSON", ErrCorrupt, offset)
+		}
+		return Record{Path: reader.path, Offset: offset, Value: line}, nil
+	}
+}
+
+// CSVInputFormat reads CSV files, one record per row. Quoted fields may span lines, so
+// a file can't be cut at any line break: every file is a single split.
+type CSVInputFormat struct {
+	Comma  rune // field separator, ',' when 0
+	Header bool // the first row names the fields and isn't a record
+}
+
+func (format CSVInputFormat) Splits(path string, splitSize int64) ([]InputSplit, error) {
+	if _, err := os.Stat(path); err != nil {
+		return nil, err
+	}
+	return []InputSplit{{Path: path}}, nil
+}
+
+func (format CSVInputFormat) Name() string {
+	comma := format.Comma
+	if comma == 0 {
+		comma = ','
+	}
+	return fmt.Sprintf("csv(comma=%q, header=%v)", comma, format.Header)
+}
+
+func (format CSVInputFormat) Open(split InputSplit) (RecordReader, error) {
+	var (
+		err    error
+		reader *csvReader
+	)
+
+	reader = &csvReader{path: split.Path, comma: format.Comma}
+	if reader.comma == 0 {
+		reader.comma = ','
+	}
+
+	if reader.file, err = os.Open(split.Path); err != nil {
+		return nil, err
+	}
+
+	reader.csv = csv.NewReader(bufio.NewReader(reader.file))
+	reader.csv.Comma = reader.comma
+	reader.csv.FieldsPerRecord = -1
+
+	if format.Header {
+		if _, err = reader.Next(); err != nil && err != io.EOF {
+			reader.Close()
+			return nil, err
+		}
+	}
+	return reader, nil
+}
+
+type csvReader struct {
+	file  *os.File
+	csv   *csv.Reader
+	path  string
+	comma rune
+}
+
+func (reader *csvReader) Next() (Record, error) {
+	var parseErr *csv.ParseError
+
+	offset := reader.csv.InputOffset()
+	fields, err := reader.csv.Read()
+	if errors.As(err, &parseErr) {
+		return Record{}, fmt.Errorf("%w: %v", ErrCorrupt, err)
+	} else if err != nil {
+		return Record{}, err
+	}
+
+	return Record{Path: reader.path, Offset: offset, Value: strings.Join(fields, string(reader.comma)), Fields: fields}, nil
+}
+
+func (reader *csvReader) Close() error {
+	return reader.file.Close()
+}
+
+// DirInputFormat reads every file of a directory with Format, TextInputFormat when nil.
+// Each file is a single split, unless ByteRanges is set: then files are split by
+// Format. Subdirectories and hidden files are skipped.
+type DirInputFormat struct {
+	Format     InputFormat
+	ByteRanges bool
+}
+
+func (format DirInputFormat) format() InputFormat {
+	if format.Format == nil {
+		return TextInputFormat{}
+	}
+	return format.Format
+}
+
+func (format DirInputFormat) Splits(path string, splitSize int64) ([]InputSplit, error) {
+	var splits []InputSplit
+
+	entries, err := os.ReadDir(path)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, entry := range entries {
+		if !entry.Type().IsRegular() || strings.HasPrefix(entry.Name(), ".") {
+			continue
+		}
+
+		fileName := filepath.Join(path, entry.Name())
+		if !format.ByteRanges {
+			splits = append(splits, InputSplit{Path: fileName})
+			continue
+		}
+
+		fileSplits, err := format.format().Splits(fileName, splitSize)
+		if err != nil {
+			return nil, err
+		}
+		splits = append(splits, fileSplits...)
+	}
+	return splits, nil
+}
+
+func (format DirInputFormat) Name() string {
+	return fmt.Sprintf("dir(%v, byteranges=%v)", format.format().Name(), format.ByteRanges)
+}
+
+func (format DirInputFormat) Open(split InputSplit) (RecordReader, error) {
+	return format.format().Open(split)
+}
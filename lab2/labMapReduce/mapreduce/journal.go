@@ -0,0 +1,213 @@
+package mapreduce
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+const (
+	JOURNAL_FILE = "master.journal"
+)
+
+type journalEntryType string
+
+// State transitions of a job recorded by the master, in the order they happen.
+// A map output can be lost after its operation is done, when the worker holding it
+// goes away. Its operation is then run again.
+const (
+	JOURNAL_CHUNKS       journalEntryType = "chunks"
+	JOURNAL_SPLIT_POINTS journalEntryType = "split-points"
+	JOURNAL_MAP_DONE     journalEntryType = "map-done"
+	JOURNAL_MAP_LOST     journalEntryType = "map-lost"
+	JOURNAL_REDUCE_DONE  journalEntryType = "reduce-done"
+	JOURNAL_JOB_DONE     journalEntryType = "job-done"
+)
+
+// journalEntry is one line of the journal file.
+type journalEntry struct {
+	Type       journalEntryType
+	Id         int              `json:",omitempty"`
+	Chunks     []string         `json:",omitempty"`
+	ReduceJobs int              `json:",omitempty"`
+	Encoding   Encoding         `json:",omitempty"`
+	Input      string           `json:",omitempty"` // Input format, see inputFormatName
+	Points     []string         `json:",omitempty"` // Split points of PARTITION_RANGE
+	Counters   map[string]int64 `json:",omitempty"` // Counts of a done operation
+	Worker     string           `json:",omitempty"` // Holds the output of a map operation
+	Token      string           `json:",omitempty"`
+}
+
+// journal is an append-only log of the state transitions of a job. Every entry is
+// synced to disk before the master moves on, so a restarted master can tell which
+// work is already done.
+type journal struct {
+	mutex sync.Mutex
+	file  *os.File
+}
+
+// jobState is the state of a job rebuilt from its journal.
+type jobState struct {
+	token       string // Tells apart the files of different runs of the same job id
+	chunks      []string
+	reduceJobs  int
+	encoding    Encoding
+	inputFormat string   // see inputFormatName
+	splitPoints []string // nil until sampled, see PARTITION_RANGE
+	mapDone     map[int]bool
+	mapWorkers  map[int]string // Hostname of the worker holding each map output
+	reduceDone  map[int]bool
+	done        bool
+
+	// Counts of the attempt that completed each operation, see counters.go
+	mapCounts    map[int]map[string]int64
+	reduceCounts map[int]map[string]int64
+}
+
+// newJobState returns the state of a job that hasn't started yet.
+func newJobState(token string, chunks []string, reduceJobs int, encoding Encoding, inputFormat string) *jobState {
+	return &jobState{
+		token:       token,
+		chunks:      chunks,
+		reduceJobs:  reduceJobs,
+		encoding:    encoding,
+		inputFormat: inputFormat,
+		mapDone:     make(map[int]bool),
+		mapWorkers:  make(map[int]string),
+		reduceDone:  make(map[int]bool),
+
+		mapCounts:    make(map[int]map[string]int64),
+		reduceCounts: make(map[int]map[string]int64),
+	}
+}
+
+// createJournal starts a new, empty journal for a job.
+func createJournal(fileName string) (*journal, error) {
+	file, err := os.Create(fileName)
+	if err != nil {
+		return nil, err
+	}
+	return &journal{file: file}, nil
+}
+
+// openJournal reopens the journal of a job to keep appending to it.
+func openJournal(fileName string) (*journal, error) {
+	file, err := os.OpenFile(fileName, os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, err
+	}
+	return &journal{file: file}, nil
+}
+
+// append writes entry to the journal and waits for it to reach the disk.
+func (j *journal) append(entry journalEntry) {
+	j.mutex.Lock()
+	defer j.mutex.Unlock()
+
+	if err := json.NewEncoder(j.file).Encode(&entry); err != nil {
+		log.Fatal(err)
+	}
+	if err := j.file.Sync(); err != nil {
+		log.Fatal(err)
+	}
+}
+
+// operationDone records that an operation of the map or reduce phase completed on the
+// worker listening on hostname, with the counts of its counters.
+func (j *journal) operationDone(operation *Operation, hostname string, counts map[string]int64) {
+	switch operation.proc {
+	case "Worker.RunMap":
+		j.append(journalEntry{Type: JOURNAL_MAP_DONE, Id: operation.id, Worker: hostname, Counters: counts})
+	case "Worker.RunReduce":
+		j.append(journalEntry{Type: JOURNAL_REDUCE_DONE, Id: operation.id, Counters: counts})
+	}
+}
+
+func (j *journal) close() {
+	j.file.Close()
+}
+
+// loadJournal rebuilds the state of the job kept in jobDir from its journal. An entry
+// cut short by a crash ends the journal. Results recorded as done whose files are
+// missing are dropped, so they're done again. Map outputs are kept by workers, a lost
+// one is only noticed when a reducer fails to fetch it.
+func loadJournal(jobDir string) (state *jobState, err error) {
+	var (
+		file     *os.File
+		scanner  *bufio.Scanner
+		fileName string
+	)
+
+	fileName = filepath.Join(jobDir, JOURNAL_FILE)
+
+	if file, err = os.Open(fileName); err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	state = newJobState("", nil, 0, ENCODING_JSON, "")
+
+	scanner = bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 0, 64*1024), 64*1024*1024)
+
+	for scanner.Scan() {
+		var entry journalEntry
+		if err = json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			log.Printf("Ignoring incomplete journal entry: %v\n", err)
+			break
+		}
+
+		switch entry.Type {
+		case JOURNAL_CHUNKS:
+			state.token = entry.Token
+			state.chunks = entry.Chunks
+			state.reduceJobs = entry.ReduceJobs
+			state.encoding = entry.Encoding
+			state.inputFormat = entry.Input
+		case JOURNAL_SPLIT_POINTS:
+			state.splitPoints = entry.Points
+		case JOURNAL_MAP_DONE:
+			state.mapDone[entry.Id] = true
+			state.mapWorkers[entry.Id] = entry.Worker
+			state.mapCounts[entry.Id] = entry.Counters
+		case JOURNAL_MAP_LOST:
+			delete(state.mapDone, entry.Id)
+			delete(state.mapWorkers, entry.Id)
+		case JOURNAL_REDUCE_DONE:
+			state.reduceDone[entry.Id] = true
+			state.reduceCounts[entry.Id] = entry.Counters
+		case JOURNAL_JOB_DONE:
+			state.done = true
+		}
+	}
+
+	if state.chunks == nil {
+		return nil, errors.New("journal " + fileName + " has no job to resume")
+	}
+
+	state.checkFiles(jobDir)
+	return state, nil
+}
+
+// checkFiles drops reduce operations recorded in the journal whose result files are
+// gone.
+func (state *jobState) checkFiles(jobDir string) {
+	for r := range state.reduceDone {
+		if !fileExists(resultFileName(jobDir, r)) {
+			delete(state.reduceDone, r)
+		}
+	}
+
+	if len(state.reduceDone) < state.reduceJobs {
+		state.done = false
+	}
+}
+
+func fileExists(fileName string) bool {
+	_, err := os.Stat(fileName)
+	return err == nil
+}
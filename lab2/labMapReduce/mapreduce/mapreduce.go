@@ -1,11 +1,11 @@
 package mapreduce
 
 import (
+	"context"
 	"log"
 	"net"
 	"net/rpc"
 	"os"
-	"time"
 )
 
 // RunSequential will ensure that map and reduce function runs in
@@ -17,8 +17,10 @@ import (
 // it and just pass a reference to reduce jobs so they can go grab it.
 func RunSequential(task *Task) {
 	var (
-		mapCounter int = 0
-		mapResult  []KeyValue
+		err          error
+		mapCounter   int = 0
+		mapResult    []KeyValue
+		reduceResult []KeyValue
 	)
 
 	log.Print("Running RunSequential...")
@@ -26,122 +28,240 @@ func RunSequential(task *Task) {
 	_ = os.Mkdir(REDUCE_PATH, os.ModePerm)
 	_ = RemoveContents(REDUCE_PATH)
 
-	for v := range task.InputChan {
-		mapResult = task.Map(v)
-		storeLocal(task, mapCounter, mapResult)
-		mapCounter++
+	if isRangePartitioned(task) && task.SplitPoints == nil {
+		sampleSequential(task)
 	}
 
-	mergeMapLocal(task, mapCounter)
+	// Every operation runs once, so their counts all add up in the same counters
+	task.counters = newCounters()
+
+	if task.InputFormat != nil {
+		for filePath := range task.InputFilePathChan {
+			if mapResult, _, err = mapSplit(task, filePath); err != nil {
+				log.Fatal(err)
+			}
+			if err = storeLocal(task, jobDir(0), mapCounter, 0, mapResult); err != nil {
+				log.Fatal(err)
+			}
+			mapCounter++
+		}
+	} else {
+		for v := range task.InputChan {
+			mapResult = task.mapChunk(v)
+			if err = storeLocal(task, jobDir(0), mapCounter, 0, mapResult); err != nil {
+				log.Fatal(err)
+			}
+			mapCounter++
+		}
+	}
+
+	if err = mergeMapLocal(task, jobDir(0), mapCounter); err != nil {
+		log.Fatal(err)
+	}
 
 	for r := 0; r < task.NumReduceJobs; r++ {
-		data := loadLocal(r)
-		task.OutputChan <- task.Reduce(data)
+		if reduceResult, err = reduceLocal(task, jobDir(0), r); err != nil {
+			log.Fatal(err)
+		}
+		if task.SortedOutput {
+			sortByKey(reduceResult)
+		}
+		task.OutputChan <- reduceResult
+	}
+
+	report := jobReport{Job: 0, MapOps: mapCounter, ReduceOps: task.NumReduceJobs, Counters: task.counters.snapshot()}
+	if err = writeReport(jobDir(0), report); err != nil {
+		log.Fatal(err)
 	}
 
 	close(task.OutputChan)
 	return
 }
 
+// sampleSequential sets the split points of task from a sample of its input. The whole
+// input is read first, so it's handed back to the map operations through new channels.
+func sampleSequential(task *Task) {
+	var err error
+
+	if task.InputFormat != nil {
+		filePaths := collectFilePaths(task.InputFilePathChan)
+		task.SplitPoints, err = sampleSplitPoints(len(filePaths), task.NumReduceJobs, func(i int) ([]string, error) {
+			return mapKeys(task, filePaths[i])
+		})
+		task.InputFilePathChan = fanFilePath(filePaths)
+	} else {
+		var chunks [][]byte
+		for chunk := range task.InputChan {
+			chunks = append(chunks, chunk)
+		}
+		task.SplitPoints, err = sampleSplitPoints(len(chunks), task.NumReduceJobs, func(i int) ([]string, error) {
+			return pairKeys(task.mapChunk(chunks[i])), nil
+		})
+
+		task.InputChan = make(chan []byte, len(chunks))
+		for _, chunk := range chunks {
+			task.InputChan <- chunk
+		}
+		close(task.InputChan)
+	}
+
+	if err != nil {
+		log.Fatal(err)
+	}
+}
+
 // RunMaster will start a master node on the map reduce operations.
 // In the distributed model, a Master should serve multiple workers and distribute
 // the operations to be executed in order to complete the task.
-// 	- task: the Task object that contains the mapreduce operation.
-//  - hostname: the tcp/ip address on which it will listen for connections.
-func RunMaster(task *Task, hostname string) {
-    var (
-        err                error
-        master             *Master
-        newRpcServer       *rpc.Server
-        listener           net.Listener
-        reduceFilePathChan chan string
-        mapOperations      int
-        reduceOperations   int
-    )
-
-    log.Println("Running Master on", hostname)
+// The job stops when ctx is done. It can be resumed later from its journal.
+//   - ctx: the context that cancels the job.
+//   - task: the Task object that contains the mapreduce operation.
+//   - hostname: the tcp/ip address on which it will listen for connections.
+func RunMaster(ctx context.Context, task *Task, hostname string) {
+	var (
+		err       error
+		master    *Master
+		singleJob *job
+	)
 
-    // Create a reduce directory to store intermediate reduce files.
-    _ = os.Mkdir(REDUCE_PATH, os.ModePerm)
-    _ = RemoveContents(REDUCE_PATH)
+	log.Println("Running Master on", hostname)
 
-    master = newMaster(hostname)
+	// Every state transition of the job goes to the journal. When resuming, the work
+	// it records as done is reused instead of being done again.
+	if task.Resume {
+		if singleJob, err = resumeJob(0); err != nil {
+			log.Fatal(err)
+		}
 
-    master.task = task
-    newRpcServer = rpc.NewServer()
-    newRpcServer.Register(master)
+		state := singleJob.state
+		task.NumReduceJobs = state.reduceJobs
+		if state.done {
+			log.Println("Job was already done before restart.")
+		}
+		log.Printf("Resuming job. Done before restart: %v/%v map and %v/%v reduce operations\n",
+			len(state.mapDone), len(state.chunks), len(state.reduceDone), state.reduceJobs)
+	} else {
+		if singleJob, err = newJob(0, collectFilePaths(task.InputFilePathChan), task.NumReduceJobs, task.Encoding, inputFormatName(task.InputFormat)); err != nil {
+			log.Fatal(err)
+		}
+	}
 
-    if err != nil {
-        log.Panicln("Failed to register RPC server. Error:", err)
-    }
+	master = startMaster(task, hostname)
 
-    master.rpcServer = newRpcServer
+	// Listed by the status server like the jobs of a long-lived master
+	master.jobsMutex.Lock()
+	master.jobs[singleJob.id] = singleJob
+	master.jobsMutex.Unlock()
 
-    listener, err = net.Listen("tcp", master.address)
+	if err = master.runJob(ctx, task, singleJob); err != nil {
+		log.Println("Job stopped. Error:", err)
+	}
 
-    if err != nil {
-        log.Panicln("Failed to start TCP server. Error:", err)
-    }
+	master.stop()
 
-    master.listener = listener
+	log.Println("Done.")
+	return
+}
 
-    // Start MapReduce Operation
+// ServeMaster will start a long-lived master node. Instead of running a single job,
+// it accepts jobs submitted through the SubmitJob RPC and runs them one after the
+// other. Workers stay registered between jobs. Each job keeps its reduce and result
+// files in its own directory under JOBS_PATH. It runs until ctx is done.
+//   - ctx: the context that stops the master, and the job it is running.
+//   - task: the Task object with the functions used by every job.
+//   - hostname: the tcp/ip address on which it will listen for connections.
+func ServeMaster(ctx context.Context, task *Task, hostname string) {
+	var (
+		master *Master
+	)
 
-    go master.acceptMultipleConnections()
-    go master.handleFailingWorkers()
+	log.Println("Serving Master on", hostname)
 
-    // Schedule map operations
-    mapOperations = master.schedule(task, "Worker.RunMap", task.InputFilePathChan)
+	_ = os.Mkdir(JOBS_PATH, os.ModePerm)
 
-    // Merge the result of multiple map operation with the same reduceId into a single file
-    mergeMapLocal(task, mapOperations)
+	master = startMaster(task, hostname)
 
-    // Schedule reduce operations
-    reduceFilePathChan = fanReduceFilePath(task.NumReduceJobs)
-    reduceOperations = master.schedule(task, "Worker.RunReduce", reduceFilePathChan)
+	master.jobsMutex.Lock()
+	master.lastJobId = lastJobDir()
+	master.jobQueue = make(chan *job, JOB_QUEUE_BUFFER)
+	master.jobsMutex.Unlock()
 
-    mergeReduceLocal(reduceOperations)
+	log.Println("Waiting for jobs.")
+	master.runJobs(ctx, task)
 
-    log.Println("Closing Remote Workers.")
-    for _, worker := range master.workers {
-        err = worker.callRemoteWorker("Worker.Done", new(struct{}), new(struct{}))
-        if err != nil {
-            log.Println("Failed to close Remote Worker. Error:", err)
-        }
-    }
+	master.stop()
 
-    log.Println("Done.")
-    return
+	log.Println("Done.")
 }
 
+// startMaster creates a master and starts accepting connections from workers.
+func startMaster(task *Task, hostname string) (master *Master) {
+	var (
+		err          error
+		newRpcServer *rpc.Server
+		listener     net.Listener
+	)
+
+	master = newMaster(hostname)
+
+	master.task = task
+
+	newRpcServer = rpc.NewServer()
+	err = newRpcServer.Register(master)
+
+	if err != nil {
+		log.Panicln("Failed to register RPC server. Error:", err)
+	}
+
+	master.rpcServer = newRpcServer
+
+	listener, err = net.Listen("tcp", master.address)
+
+	if err != nil {
+		log.Panicln("Failed to start TCP server. Error:", err)
+	}
+
+	master.listener = listener
+
+	go master.acceptMultipleConnections()
+	go master.handleFailingWorkers()
+
+	if task.StatusAddress != "" {
+		master.startStatusServer(task.StatusAddress)
+	}
+	return master
+}
 
 // RunWorker will run a instance of a worker. It'll initialize and then try to register with
-// master.
+// master. The worker runs up to slots operations at the same time.
 // Induced failures:
-// -> nOps = number of operations to run before failure (0 = no failure)
-func RunWorker(task *Task, hostname string, masterHostname string, nOps int) {
+// -> faults = faults injected into the operations run by the worker (nil = no faults)
+func RunWorker(task *Task, hostname string, masterHostname string, slots int, faults *FaultSpec) {
 	var (
-		err           error
-		worker        *Worker
-		rpcs          *rpc.Server
-		listener      net.Listener
-		retryDuration time.Duration
+		err      error
+		worker   *Worker
+		rpcs     *rpc.Server
+		listener net.Listener
 	)
 
 	log.Println("Running Worker on", hostname)
 
-	_ = os.Mkdir(REDUCE_PATH, os.ModePerm)
+	// Files kept by a previous run of this worker can't be fetched by anyone anymore:
+	// the master either finished with them or will run their operations again.
+	_ = os.RemoveAll(workerStorageRoot(hostname))
 
 	worker = new(Worker)
 	worker.hostname = hostname
 	worker.masterHostname = masterHostname
 	worker.task = task
 	worker.done = make(chan bool)
+	worker.operations = make(map[string]context.CancelFunc)
+	worker.metrics = newWorkerMetrics()
+	worker.slots = slots
 
-	// Should induce a failure
-	if nOps > 0 {
-		worker.taskCounter = 0
-		worker.nOps = nOps
+	// Should induce failures
+	if worker.faults, err = newFaultInjector(faults); err != nil {
+		log.Fatal(err)
 	}
 
 	rpcs = rpc.NewServer()
@@ -158,19 +278,16 @@ func RunWorker(task *Task, hostname string, masterHostname string, nOps int) {
 	worker.listener = listener
 	defer worker.listener.Close()
 
-	retryDuration = time.Duration(2) * time.Second
-	for {
-		err = worker.register()
-
-		if err == nil {
-			break
+	if task.MetricsAddress != "" {
+		if server := serveMetrics(task.MetricsAddress, worker.metrics.list()...); server != nil {
+			defer server.Close()
 		}
-
-		log.Printf("Registration failed. Retrying in %v seconds...\n", retryDuration)
-		time.Sleep(retryDuration)
 	}
 
+	worker.registerWithRetry()
+
 	go worker.acceptMultipleConnections()
+	go worker.watchMaster()
 
 	<-worker.done
 }
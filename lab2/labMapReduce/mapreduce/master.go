@@ -3,13 +3,16 @@ package mapreduce
 import (
 	"log"
 	"net"
+	"net/http"
 	"net/rpc"
 	"sync"
+	"time"
 )
 
 const (
-	IDLE_WORKER_BUFFER     = 100
+	IDLE_WORKER_BUFFER     = 1000 // free slots of every worker
 	RETRY_OPERATION_BUFFER = 100
+	WORKER_DONE_TIMEOUT    = 5 * time.Second // to wait for workers to close when the master stops
 )
 
 type Master struct {
@@ -30,18 +33,59 @@ type Master struct {
 	failedWorkerChan chan *RemoteWorker
 
 	// Retry operations
-    failedOperationsChan chan *Operation
-    totalOperations      int
-    successOperations    int
-
-    // Mutex para operações
-    operationsMutex sync.Mutex
+	failedOperationsChan chan *Operation
+	operationDoneChan    chan struct{}
+
+	// Operations of the current phase, guarded by operationsMutex. Reset by
+	// startPhase at the beginning of every phase.
+	phaseJob          *job
+	phaseProc         string
+	phaseStart        time.Time
+	operations        []*Operation
+	durations         []time.Duration // How long the done operations took
+	totalOperations   int
+	successOperations int
+	retriedOperations int
+	blockedOperations int
+	localOperations   int // map attempts started on a worker holding their chunk
+	remoteOperations  int
+
+	// Mutex para operações
+	operationsMutex sync.Mutex
+
+	// Closed when the master is done, stops the heartbeats
+	done chan struct{}
+
+	// HTTP server with the status and metrics of the master, nil unless
+	// task.StatusAddress is set
+	statusServer *http.Server
+	metrics      *masterMetrics
+
+	// Jobs submitted through SubmitJob, guarded by jobsMutex. Only a master started
+	// with ServeMaster has a job queue.
+	jobsMutex sync.Mutex
+	jobs      map[int]*job
+	jobQueue  chan *job
+	lastJobId int // Used to generate unique ids for new jobs
 }
 
 type Operation struct {
+	job      *job
 	proc     string
 	id       int
 	filePath string
+
+	// State and attempts, guarded by Master.operationsMutex
+	state     operationState
+	attempts  int       // attempts started so far, also the number of the next one
+	running   int       // attempts currently running
+	backup    bool      // a backup attempt was started for the current attempt
+	startTime time.Time // start of the current (non-backup) attempt
+	worker    string    // hostname of the worker running the latest attempt
+	duration  time.Duration
+
+	// When the operation last became pending, only used by the scheduler
+	pendingSince time.Time
 }
 
 // Construct a new Master struct
@@ -53,14 +97,63 @@ func newMaster(address string) (master *Master) {
 	master.failedWorkerChan = make(chan *RemoteWorker, IDLE_WORKER_BUFFER)
 
 	// Inicializa os canais e contadores
-    master.failedOperationsChan = make(chan *Operation, RETRY_OPERATION_BUFFER)
-    master.totalOperations = 0
-    master.successOperations = 0
-	
+	master.failedOperationsChan = make(chan *Operation, RETRY_OPERATION_BUFFER)
+	master.operationDoneChan = make(chan struct{}, 1)
+	master.totalOperations = 0
+	master.successOperations = 0
+
 	master.totalWorkers = 0
+	master.done = make(chan struct{})
+	master.jobs = make(map[int]*job)
+	master.metrics = newMasterMetrics()
 	return
 }
 
+// stop ends the heartbeats and closes the remote workers once the master is done.
+// Workers that don't answer within WORKER_DONE_TIMEOUT are left behind.
+func (master *Master) stop() {
+	var (
+		workers []*RemoteWorker
+		calls   []*rpc.Call
+	)
+
+	// Stop the heartbeats before the workers go away
+	close(master.done)
+
+	master.stopStatusServer()
+
+	log.Println("Closing Remote Workers.")
+
+	// Waiting for workers under the lock would block Register and the status server
+	master.workersMutex.Lock()
+	workers = make([]*RemoteWorker, 0, len(master.workers))
+	for _, worker := range master.workers {
+		workers = append(workers, worker)
+	}
+	master.workersMutex.Unlock()
+
+	calls = make([]*rpc.Call, 0, len(workers))
+	for _, worker := range workers {
+		calls = append(calls, worker.goRemoteWorker("Worker.Done", new(struct{}), new(struct{}), nil))
+	}
+
+	deadline := time.After(WORKER_DONE_TIMEOUT)
+	for i, call := range calls {
+		select {
+		case <-call.Done:
+			if call.Error != nil {
+				log.Println("Failed to close Remote Worker. Error:", call.Error)
+			}
+		case <-deadline:
+			log.Printf("Remote Worker %v didn't close within %v.\n", workers[i].id, WORKER_DONE_TIMEOUT)
+		}
+	}
+
+	for _, worker := range workers {
+		worker.close()
+	}
+}
+
 // acceptMultipleConnections will handle the connections from multiple workers.
 func (master *Master) acceptMultipleConnections() {
 	var (
@@ -74,7 +167,9 @@ func (master *Master) acceptMultipleConnections() {
 		newConn, err = master.listener.Accept()
 
 		if err == nil {
-			go master.handleConnection(&newConn)
+			// Each goroutine needs its own copy, newConn is reused by the next Accept.
+			conn := newConn
+			go master.handleConnection(&conn)
 		} else {
 			log.Println("Failed to accept connection. Error: ", err)
 			break
@@ -84,14 +179,17 @@ func (master *Master) acceptMultipleConnections() {
 	log.Println("Stopped accepting connections.")
 }
 
-// handleFailingWorkers will handle workers that fail during an operation.
+// handleFailingWorkers will handle workers that fail during an operation or stop
+// answering heartbeats.
 func (master *Master) handleFailingWorkers() {
 	for worker := range master.failedWorkerChan {
-        master.workersMutex.Lock()
-        delete(master.workers, worker.id)
-        master.workersMutex.Unlock()
-        log.Printf("Removendo worker %d da lista do master.\n", worker.id)
-    }
+		master.workersMutex.Lock()
+		delete(master.workers, worker.id)
+		master.workersMutex.Unlock()
+
+		master.removeIdleWorker(worker)
+		log.Printf("Removendo worker %d da lista do master.\n", worker.id)
+	}
 }
 
 // Handle a single connection until it's done, then closes it.
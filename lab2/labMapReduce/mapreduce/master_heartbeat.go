@@ -0,0 +1,101 @@
+package mapreduce
+
+import (
+	"log"
+	"time"
+)
+
+const (
+	HEARTBEAT_INTERVAL = time.Second
+	HEARTBEAT_TIMEOUT  = 3 * time.Second
+)
+
+// Returns the heartbeat interval and timeout configured in task, or their defaults.
+func heartbeatSettings(task *Task) (interval time.Duration, timeout time.Duration) {
+	interval, timeout = task.HeartbeatInterval, task.HeartbeatTimeout
+
+	if interval <= 0 {
+		interval = HEARTBEAT_INTERVAL
+	}
+	if timeout <= 0 {
+		timeout = HEARTBEAT_TIMEOUT
+	}
+	return interval, timeout
+}
+
+// monitorWorker pings a registered worker every heartbeat interval until the job is
+// done. A worker that doesn't answer for longer than the heartbeat timeout is declared
+// failed, even if it's idle or blocked in the middle of an operation.
+func (master *Master) monitorWorker(worker *RemoteWorker) {
+	var (
+		err           error
+		interval      time.Duration
+		timeout       time.Duration
+		lastHeartbeat time.Time
+		ticker        *time.Ticker
+	)
+
+	interval, timeout = heartbeatSettings(master.task)
+	lastHeartbeat = time.Now()
+
+	ticker = time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-master.done:
+			return
+		case <-ticker.C:
+		}
+
+		if worker.isFailed() {
+			return
+		}
+
+		if err = worker.ping(interval); err == nil {
+			lastHeartbeat = time.Now()
+			continue
+		}
+
+		if time.Since(lastHeartbeat) > timeout {
+			log.Printf("Worker %v missed heartbeats for %v. Last error: %v\n", worker.id, time.Since(lastHeartbeat).Round(time.Millisecond), err)
+			master.failWorker(worker)
+			return
+		}
+	}
+}
+
+// failWorker marks worker as failed and sends it to be handled by handleFailingWorkers.
+// If the worker is running an operation, its connection is closed so runOperation
+// returns and re-enqueues the operation. Calling it more than once has no effect.
+func (master *Master) failWorker(worker *RemoteWorker) {
+	if worker.setFailed() {
+		master.failedWorkerChan <- worker
+	}
+}
+
+// removeIdleWorker drains worker from the idle pool, keeping every other idle worker.
+func (master *Master) removeIdleWorker(worker *RemoteWorker) {
+	for i := len(master.idleWorkerChan); i > 0; i-- {
+		select {
+		case idle := <-master.idleWorkerChan:
+			if idle != worker {
+				master.idleWorkerChan <- idle
+			}
+		default:
+			return
+		}
+	}
+}
+
+// nextIdleWorker blocks until a worker is available, skipping workers that failed
+// while they were waiting in the idle pool.
+func (master *Master) nextIdleWorker() *RemoteWorker {
+	for {
+		worker := <-master.idleWorkerChan
+
+		if !worker.isFailed() {
+			return worker
+		}
+	}
+}
@@ -0,0 +1,521 @@
+package mapreduce
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"time"
+)
+
+const (
+	JOB_QUEUE_BUFFER = 100
+	FINISHED_JOBS    = 100 // finished jobs a long-lived master keeps for WaitJob and its status
+)
+
+// job is a MapReduce job run by the master, from its map operations to the final
+// result file.
+type job struct {
+	id      int
+	dir     string // Where its result files are kept, see jobDir
+	state   *jobState
+	journal *journal
+	trace   *jobTrace // nil unless task.TraceFile is set
+
+	// Closed when the job is done, err tells if it failed
+	done chan struct{}
+	err  error
+
+	// Stops a running job with the error given, see runOperation
+	abort context.CancelCauseFunc
+}
+
+// newJob creates the result directory and the journal of a job that hasn't started
+// yet. Results left in the directory by an earlier run of the same job id are removed.
+func newJob(id int, chunks []string, reduceJobs int, encoding Encoding, inputFormat string) (newJob *job, err error) {
+	newJob = &job{
+		id:    id,
+		dir:   jobDir(id),
+		state: newJobState(strconv.FormatInt(time.Now().UnixNano(), 36), chunks, reduceJobs, encoding, inputFormat),
+		done:  make(chan struct{}),
+	}
+
+	if err = os.MkdirAll(filepath.Join(newJob.dir, RESULT_PATH), os.ModePerm); err != nil {
+		return nil, err
+	}
+
+	if err = RemoveContents(filepath.Join(newJob.dir, RESULT_PATH)); err != nil {
+		return nil, err
+	}
+
+	if newJob.journal, err = createJournal(filepath.Join(newJob.dir, JOURNAL_FILE)); err != nil {
+		return nil, err
+	}
+
+	newJob.journal.append(journalEntry{Type: JOURNAL_CHUNKS, Chunks: chunks, ReduceJobs: reduceJobs, Encoding: encoding, Input: inputFormat, Token: newJob.state.token})
+	return newJob, nil
+}
+
+// resumeJob rebuilds a job interrupted by a master restart from its journal.
+func resumeJob(id int) (resumedJob *job, err error) {
+	resumedJob = &job{
+		id:   id,
+		dir:  jobDir(id),
+		done: make(chan struct{}),
+	}
+
+	if resumedJob.state, err = loadJournal(resumedJob.dir); err != nil {
+		return nil, err
+	}
+
+	if resumedJob.journal, err = openJournal(filepath.Join(resumedJob.dir, JOURNAL_FILE)); err != nil {
+		return nil, err
+	}
+	return resumedJob, nil
+}
+
+// runJob runs every phase of job on the registered workers and returns when its final
+// result is written, or with the error of ctx if it's done first. Work recorded as done
+// in the state of the job is skipped.
+// Reducers fetch their input from the workers that ran the map operations. When some
+// of that output is lost, the reduce operations that needed it are blocked and the
+// job goes through another round: the lost map operations are run again, then the
+// blocked reduce operations.
+// With task.TraceFile set, the timeline of the job is written there once it's over.
+// An operation that fails with a fatal error stops the job with a report of it.
+func (master *Master) runJob(ctx context.Context, task *Task, job *job) (err error) {
+	defer func() {
+		job.err = err
+		close(job.done)
+	}()
+	defer job.journal.close()
+
+	ctx, job.abort = context.WithCancelCause(ctx)
+	defer job.abort(nil)
+
+	if task.TraceFile != "" {
+		job.trace = newJobTrace()
+		defer func() {
+			fileName := traceFileName(task.TraceFile, job.id)
+			if err := job.trace.write(fileName); err != nil {
+				log.Printf("Failed to write trace of job %v. Error: %v\n", job.id, err)
+				return
+			}
+			log.Printf("Trace of job %v written to %v\n", job.id, fileName)
+		}()
+	}
+
+	if isRangePartitioned(task) && job.state.splitPoints == nil {
+		if err = master.sampleJob(ctx, task, job); err != nil {
+			return err
+		}
+	}
+
+	for round := 0; master.doneCount(job.state.reduceDone) < job.state.reduceJobs; round++ {
+		if round > 0 {
+			log.Printf("Running lost map operations of job %v again (round %v)\n", job.id, round)
+		}
+
+		// Schedule map operations
+		if _, err = master.schedule(ctx, task, job, "Worker.RunMap", fanFilePath(job.state.chunks), master.doneOperations(job.state.mapDone)); err != nil {
+			return err
+		}
+
+		// Schedule reduce operations
+		if _, err = master.schedule(ctx, task, job, "Worker.RunReduce", fanReduceFilePath(job.dir, job.state.reduceJobs), master.doneOperations(job.state.reduceDone)); err != nil {
+			return err
+		}
+	}
+
+	if err = mergeReduceLocal(task, job.dir, job.state.reduceJobs); err != nil {
+		return err
+	}
+
+	master.operationsMutex.Lock()
+	report := jobReport{
+		Job:        job.id,
+		MapOps:     len(job.state.chunks),
+		ReduceOps:  job.state.reduceJobs,
+		ResultFile: finalResultFileName(job.dir),
+		Counters:   operationCounts(job.state.mapCounts, job.state.reduceCounts),
+	}
+	master.operationsMutex.Unlock()
+
+	if err = writeReport(job.dir, report); err != nil {
+		return err
+	}
+
+	job.journal.append(journalEntry{Type: JOURNAL_JOB_DONE})
+	return nil
+}
+
+// sampleJob sets the split points of job, which partitions keys with PARTITION_RANGE:
+// the ones of task when it has them, or the ones sampled from the input of job by the
+// workers. They're recorded in the journal, so a resumed job keeps partitioning keys
+// the same way.
+func (master *Master) sampleJob(ctx context.Context, task *Task, job *job) (err error) {
+	splitPoints := task.SplitPoints
+	if splitPoints == nil {
+		log.Printf("Sampling the input of job %v\n", job.id)
+
+		splitPoints, err = sampleSplitPoints(len(job.state.chunks), job.state.reduceJobs, func(i int) ([]string, error) {
+			return master.sampleChunk(ctx, task, job, job.state.chunks[i])
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	job.state.splitPoints = splitPoints
+	if job.state.splitPoints == nil {
+		job.state.splitPoints = []string{}
+	}
+	job.journal.append(journalEntry{Type: JOURNAL_SPLIT_POINTS, Points: job.state.splitPoints})
+	return nil
+}
+
+// sampleChunk returns the keys emitted by mapping filePath, an input chunk of job, on
+// an idle worker. A worker that fails while sampling, or takes longer than
+// task.OperationTimeout, is replaced by another one.
+func (master *Master) sampleChunk(ctx context.Context, task *Task, job *job, filePath string) ([]string, error) {
+	args := &RunArgs{
+		JobId:       job.id,
+		JobToken:    job.state.token,
+		ReduceJobs:  job.state.reduceJobs,
+		FilePath:    filePath,
+		Encoding:    job.state.encoding,
+		InputFormat: job.state.inputFormat,
+	}
+
+	for {
+		remoteWorker, err := master.sampleWorker(ctx, task, filePath)
+		if err != nil {
+			return nil, err
+		}
+
+		var timeout <-chan time.Time
+		if task.OperationTimeout > 0 {
+			timeout = time.After(task.OperationTimeout)
+		}
+
+		reply := new(SampleReply)
+		slot := remoteWorker.acquireSlot()
+		call := remoteWorker.goRemoteWorker("Worker.SampleMap", args, reply, nil)
+
+		// A sample given up on keeps its slot busy until the worker is done with it
+		releaseLater := func() {
+			go func() {
+				<-call.Done
+				master.releaseSlot(remoteWorker, slot)
+			}()
+		}
+
+		select {
+		case <-call.Done:
+			err = call.Error
+		case <-timeout:
+			log.Printf("Sampling '%v' timed out on worker '%v'\n", filePath, remoteWorker.hostname)
+			releaseLater()
+			continue
+		case <-ctx.Done():
+			releaseLater()
+			return nil, context.Cause(ctx)
+		}
+
+		if isConnectionError(err) {
+			log.Printf("Sampling '%v' failed on worker '%v'. Error: %v\n", filePath, remoteWorker.hostname, err)
+			remoteWorker.releaseSlot(slot)
+			master.failWorker(remoteWorker)
+			continue
+		}
+
+		master.releaseSlot(remoteWorker, slot)
+		if err != nil {
+			return nil, fmt.Errorf("sampling '%v' failed on worker '%v': %v", filePath, remoteWorker.hostname, err)
+		}
+		return reply.Keys, nil
+	}
+}
+
+// sampleWorker takes an idle worker from the pool to sample filePath on, like a map
+// operation would get: one holding the chunk, unless none of the live workers does or
+// none is idle within task.LocalityDelay. The other workers taken go back to the pool.
+func (master *Master) sampleWorker(ctx context.Context, task *Task, filePath string) (*RemoteWorker, error) {
+	var (
+		taken   []*RemoteWorker
+		expired bool
+		expiry  = time.After(localityDelay(task))
+	)
+
+	defer func() {
+		for _, worker := range taken {
+			master.idleWorkerChan <- worker
+		}
+	}()
+
+	for {
+		select {
+		case worker := <-master.idleWorkerChan:
+			if worker.isFailed() {
+				continue
+			}
+			if expired || worker.hasChunk(filePath) || !master.hasChunkHolder(filePath) {
+				return worker, nil
+			}
+			taken = append(taken, worker)
+
+		case <-expiry:
+			expired, expiry = true, nil
+			if len(taken) > 0 {
+				worker := taken[0]
+				taken = taken[1:]
+				return worker, nil
+			}
+
+		case <-ctx.Done():
+			return nil, context.Cause(ctx)
+		}
+	}
+}
+
+// operationDone records in the state and journal of its job that operation completed
+// on remoteWorker, with the counts of its counters. A map operation run again after its
+// output was lost replaces the counts of the earlier run.
+func (master *Master) operationDone(operation *Operation, remoteWorker *RemoteWorker, counts map[string]int64) {
+	state := operation.job.state
+
+	master.operationsMutex.Lock()
+	switch operation.proc {
+	case "Worker.RunMap":
+		state.mapDone[operation.id] = true
+		state.mapWorkers[operation.id] = remoteWorker.hostname
+		state.mapCounts[operation.id] = counts
+	case "Worker.RunReduce":
+		state.reduceDone[operation.id] = true
+		state.reduceCounts[operation.id] = counts
+	}
+	master.operationsMutex.Unlock()
+
+	operation.job.journal.operationDone(operation, remoteWorker.hostname, counts)
+}
+
+// mapOutputsLost records that the output of the map operations in lostMaps can't be
+// fetched anymore, so they run again in the next round of job.
+func (master *Master) mapOutputsLost(job *job, lostMaps []int) {
+	var lost []int
+
+	master.operationsMutex.Lock()
+	for _, m := range lostMaps {
+		if job.state.mapDone[m] {
+			delete(job.state.mapDone, m)
+			delete(job.state.mapWorkers, m)
+			lost = append(lost, m)
+		}
+	}
+	master.operationsMutex.Unlock()
+
+	// Every reducer reports the same lost outputs, they're only recorded once.
+	for _, m := range lost {
+		job.journal.append(journalEntry{Type: JOURNAL_MAP_LOST, Id: m})
+	}
+}
+
+// doneOperations returns a copy of done, which attempts left over by a previous phase
+// may still change.
+func (master *Master) doneOperations(done map[int]bool) map[int]bool {
+	master.operationsMutex.Lock()
+	defer master.operationsMutex.Unlock()
+
+	operations := make(map[int]bool, len(done))
+	for id := range done {
+		operations[id] = true
+	}
+	return operations
+}
+
+// doneCount returns how many operations are in done, which attempts left over by a
+// previous phase may still change.
+func (master *Master) doneCount(done map[int]bool) int {
+	master.operationsMutex.Lock()
+	defer master.operationsMutex.Unlock()
+
+	return len(done)
+}
+
+// mapWorkers returns the hostname of the worker holding the output of every map
+// operation of job, indexed by map id.
+func (master *Master) mapWorkers(job *job) []string {
+	master.operationsMutex.Lock()
+	defer master.operationsMutex.Unlock()
+
+	hostnames := make([]string, len(job.state.chunks))
+	for m := range hostnames {
+		hostnames[m] = job.state.mapWorkers[m]
+	}
+	return hostnames
+}
+
+// fetchResult copies the result of a reduce operation from the worker that ran it to
+// the result directory of its job. Only the first attempt to get there is kept.
+func (master *Master) fetchResult(ctx context.Context, remoteWorker *RemoteWorker, operation *Operation, attempt int) error {
+	var (
+		err       error
+		fileName  string
+		args      FetchArgs
+		committed bool
+	)
+
+	fileName = resultFileName(operation.job.dir, operation.id)
+	args = FetchArgs{JobId: operation.job.id, JobToken: operation.job.state.token, ReduceId: operation.id}
+
+	call := func(proc string, args interface{}, reply interface{}) error {
+		return remoteWorker.callRemoteWorker(ctx, proc, args, reply)
+	}
+
+	if err = fetchFile(call, "Worker.FetchResult", args, attemptFileName(fileName, attempt)); err != nil {
+		os.Remove(attemptFileName(fileName, attempt))
+		return err
+	}
+
+	if committed, err = commitFile(attemptFileName(fileName, attempt), fileName); err == nil && !committed {
+		log.Printf("Discarding result of attempt %v of reduce %v, another one was already committed.\n", attempt, operation.id)
+	}
+	return err
+}
+
+// runJobs runs the submitted jobs one after the other, in the order they were queued,
+// until ctx is done.
+func (master *Master) runJobs(ctx context.Context, task *Task) {
+	master.jobsMutex.Lock()
+	jobQueue := master.jobQueue
+	master.jobsMutex.Unlock()
+
+	for {
+		var queuedJob *job
+
+		select {
+		case queuedJob = <-jobQueue:
+		case <-ctx.Done():
+			master.cancelQueuedJobs(ctx.Err())
+			return
+		}
+
+		log.Printf("Running job %v (%v chunks, %v reduce jobs)\n", queuedJob.id, len(queuedJob.state.chunks), queuedJob.state.reduceJobs)
+		if err := master.runJob(ctx, task, queuedJob); err != nil {
+			log.Printf("Job %v stopped. Error: %v\n", queuedJob.id, err)
+		} else {
+			log.Printf("Job %v done. Result: %v\n", queuedJob.id, finalResultFileName(queuedJob.dir))
+		}
+
+		master.forgetFinishedJobs()
+	}
+}
+
+// forgetFinishedJobs removes the oldest finished jobs once there are more than
+// FINISHED_JOBS of them. Their directories are kept, only WaitJob and the status
+// server stop knowing them.
+func (master *Master) forgetFinishedJobs() {
+	var finished []int
+
+	master.jobsMutex.Lock()
+	defer master.jobsMutex.Unlock()
+
+	for id, j := range master.jobs {
+		select {
+		case <-j.done:
+			finished = append(finished, id)
+		default:
+		}
+	}
+
+	if len(finished) <= FINISHED_JOBS {
+		return
+	}
+
+	sort.Ints(finished)
+	for _, id := range finished[:len(finished)-FINISHED_JOBS] {
+		delete(master.jobs, id)
+	}
+}
+
+// cancelQueuedJobs stops the jobs that are still queued with err, so clients waiting
+// for them return.
+func (master *Master) cancelQueuedJobs(err error) {
+	master.jobsMutex.Lock()
+	defer master.jobsMutex.Unlock()
+
+	// No job is queued anymore
+	master.jobQueue = nil
+
+	for _, queuedJob := range master.jobs {
+		select {
+		case <-queuedJob.done:
+		default:
+			queuedJob.err = err
+			close(queuedJob.done)
+		}
+	}
+}
+
+// submitJob creates a job and queues it to be run after the ones submitted before it.
+func (master *Master) submitJob(chunks []string, reduceJobs int, encoding Encoding, inputFormat string) (int, error) {
+	var (
+		err          error
+		submittedJob *job
+	)
+
+	master.jobsMutex.Lock()
+	defer master.jobsMutex.Unlock()
+
+	if master.jobQueue == nil {
+		return 0, errors.New("master doesn't accept jobs")
+	}
+
+	if len(master.jobQueue) == cap(master.jobQueue) {
+		return 0, fmt.Errorf("job queue is full (%v jobs)", cap(master.jobQueue))
+	}
+
+	if submittedJob, err = newJob(master.lastJobId+1, chunks, reduceJobs, encoding, inputFormat); err != nil {
+		return 0, err
+	}
+
+	master.lastJobId = submittedJob.id
+	master.jobs[submittedJob.id] = submittedJob
+	master.jobQueue <- submittedJob
+
+	log.Printf("Queued job %v (%v chunks, %v reduce jobs)\n", submittedJob.id, len(chunks), reduceJobs)
+	return submittedJob.id, nil
+}
+
+// lookupJob returns the job with id, or nil if no such job was submitted.
+func (master *Master) lookupJob(id int) *job {
+	master.jobsMutex.Lock()
+	defer master.jobsMutex.Unlock()
+
+	return master.jobs[id]
+}
+
+// lastJobDir returns the highest job id with a directory in JOBS_PATH, so a restarted
+// master doesn't hand out the ids of jobs it ran before.
+func lastJobDir() (lastId int) {
+	var (
+		err     error
+		entries []os.DirEntry
+		id      int
+	)
+
+	if entries, err = os.ReadDir(JOBS_PATH); err != nil {
+		return 0
+	}
+
+	for _, entry := range entries {
+		if _, err = fmt.Sscanf(entry.Name(), "job-%d", &id); err == nil && id > lastId {
+			lastId = id
+		}
+	}
+	return lastId
+}
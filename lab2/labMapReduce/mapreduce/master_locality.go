@@ -0,0 +1,119 @@
+package mapreduce
+
+import (
+	"context"
+	"path/filepath"
+	"time"
+)
+
+const (
+	LOCALITY_DELAY = 3 * time.Second
+)
+
+// Workers report the input chunks on their own disk when they register, see
+// Task.LocalChunks. A map operation is data-local when it runs on a worker holding its
+// chunk, and remote otherwise.
+//
+// Idle workers get a pending map operation local to them first. A worker without one
+// is held by the scheduler, so the operations can wait for a worker holding their
+// chunk, until one of them has been pending for task.LocalityDelay or none of the live
+// workers holds it. Then it runs remote on whichever worker is held.
+
+// hasChunk returns true if the worker reported the file read by a map operation with
+// filePath as one of its local chunks. Splits of a byte range are local to the worker
+// holding their whole file.
+func (worker *RemoteWorker) hasChunk(filePath string) bool {
+	return worker.chunks[filepath.Clean(ParseInputSplit(filePath).Path)]
+}
+
+// hasChunkHolder returns true if a live worker reported filePath as a local chunk.
+func (master *Master) hasChunkHolder(filePath string) bool {
+	master.workersMutex.Lock()
+	defer master.workersMutex.Unlock()
+
+	for _, worker := range master.workers {
+		if worker.hasChunk(filePath) && !worker.isFailed() {
+			return true
+		}
+	}
+	return false
+}
+
+func localityDelay(task *Task) time.Duration {
+	if task.LocalityDelay <= 0 {
+		return LOCALITY_DELAY
+	}
+	return task.LocalityDelay
+}
+
+// assignOperations hands pending operations to the held workers, the ones local to each
+// worker first. Returns the workers still held and the operations still pending. Once
+// nothing is pending, the held workers go back to the idle pool, where backup attempts
+// can get them.
+func (master *Master) assignOperations(ctx context.Context, task *Task, proc string, held []*RemoteWorker, pending []*Operation) ([]*RemoteWorker, []*Operation) {
+	var waiting []*RemoteWorker
+
+	for _, worker := range held {
+		if worker.isFailed() {
+			continue
+		}
+
+		if len(pending) == 0 {
+			master.idleWorkerChan <- worker
+			continue
+		}
+
+		i := master.pickOperation(task, proc, worker, pending)
+		if i < 0 {
+			waiting = append(waiting, worker)
+			continue
+		}
+
+		// pending shares its array with master.operations, so it's copied instead of
+		// shifted in place
+		operation := pending[i]
+		pending = append(pending[:i:i], pending[i+1:]...)
+
+		master.setOperationState(operation, OPERATION_RUNNING)
+		go master.runOperation(ctx, task, worker, operation, false)
+	}
+	return waiting, pending
+}
+
+// pickOperation returns the index in pending of the operation worker should run, or -1
+// if worker should be held until an operation local to it is pending. Only map
+// operations have an input chunk, any other runs on the first idle worker.
+func (master *Master) pickOperation(task *Task, proc string, worker *RemoteWorker, pending []*Operation) int {
+	if proc != "Worker.RunMap" {
+		return 0
+	}
+
+	for i, operation := range pending {
+		if worker.hasChunk(operation.filePath) {
+			return i
+		}
+	}
+
+	for i, operation := range pending {
+		if time.Since(operation.pendingSince) >= localityDelay(task) || !master.hasChunkHolder(operation.filePath) {
+			return i
+		}
+	}
+	return -1
+}
+
+// localityWait returns how long until the first of pending may run remote.
+func localityWait(task *Task, pending []*Operation) time.Duration {
+	var wait time.Duration = localityDelay(task)
+
+	for _, operation := range pending {
+		if left := localityDelay(task) - time.Since(operation.pendingSince); left < wait {
+			wait = left
+		}
+	}
+
+	if wait < 0 {
+		return 0
+	}
+	return wait
+}
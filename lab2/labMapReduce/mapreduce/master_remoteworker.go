@@ -1,8 +1,12 @@
 package mapreduce
 
 import (
-	"io"
+	"context"
+	"errors"
+	"net"
 	"net/rpc"
+	"path/filepath"
+	"sync"
 	"time"
 )
 
@@ -11,46 +15,280 @@ type workerStatus string
 const (
 	WORKER_IDLE    workerStatus = "idle"
 	WORKER_RUNNING workerStatus = "running"
+	WORKER_FAILED  workerStatus = "failed"
+)
+
+const (
+	WORKER_DIAL_TIMEOUT = 3 * time.Second
+	MAX_WORKER_SLOTS    = 64
 )
 
 type RemoteWorker struct {
 	id       int
 	hostname string
 	status   workerStatus
+	slots    int
+	chunks   map[string]bool // input chunks on the disk of the worker, never changed
+
+	// Slots running an operation, guarded by mutex
+	busySlots []bool
+	running   int
+
+	// Long-lived connection shared by every call to the worker. It's dialed again
+	// when it breaks and closed for good when the worker fails.
+	mutex  sync.Mutex
+	client *rpc.Client
 }
 
-// Call a RemoteWork with the procedure specified in parameters. It will also handle connecting
-// to the server and closing it afterwards.
-func (worker *RemoteWorker) callRemoteWorker(proc string, args interface{}, reply interface{}) error {
+func newRemoteWorker(id int, hostname string, slots int, chunks []string) *RemoteWorker {
+	// Workers that don't say how many slots they have run one operation at a time.
+	// Every slot is an entry of the idle pool, so a worker can't have too many.
+	if slots < 1 {
+		slots = 1
+	}
+	if slots > MAX_WORKER_SLOTS {
+		slots = MAX_WORKER_SLOTS
+	}
+
+	worker := &RemoteWorker{
+		id:        id,
+		hostname:  hostname,
+		status:    WORKER_IDLE,
+		slots:     slots,
+		chunks:    make(map[string]bool, len(chunks)),
+		busySlots: make([]bool, slots),
+	}
+
+	for _, chunk := range chunks {
+		worker.chunks[filepath.Clean(chunk)] = true
+	}
+	return worker
+}
+
+// Call a RemoteWork with the procedure specified in parameters and wait for it to
+// return, or for ctx to be done. The error is a rpc.ServerError if the procedure itself
+// failed and the error of ctx if it was done first. Any other error means the worker
+// couldn't be reached or the connection broke during the call.
+func (worker *RemoteWorker) callRemoteWorker(ctx context.Context, proc string, args interface{}, reply interface{}) error {
+	call := worker.goRemoteWorker(proc, args, reply, make(chan *rpc.Call, 1))
+
+	select {
+	case <-call.Done:
+		return call.Error
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// goRemoteWorker calls a procedure on the worker without waiting for it, like
+// rpc.Client.Go, so several calls can be in flight on the same connection. The call is
+// sent on done once it's complete. If done is nil a new channel is allocated, otherwise
+// it must be buffered.
+func (worker *RemoteWorker) goRemoteWorker(proc string, args interface{}, reply interface{}, done chan *rpc.Call) *rpc.Call {
 	var (
 		err    error
 		client *rpc.Client
+		call   *rpc.Call
 	)
 
-	client, err = rpc.Dial("tcp", worker.hostname)
+	if done == nil {
+		done = make(chan *rpc.Call, 1)
+	}
+
+	call = &rpc.Call{ServiceMethod: proc, Args: args, Reply: reply, Done: done}
+
+	if client, err = worker.connect(); err != nil {
+		call.Error = err
+		call.Done <- call
+		return call
+	}
+
+	clientCall := client.Go(proc, args, reply, make(chan *rpc.Call, 1))
+
+	go func() {
+		<-clientCall.Done
+
+		// The next call dials again
+		if isConnectionError(clientCall.Error) {
+			worker.disconnect(client)
+		}
+
+		call.Error = clientCall.Error
+		call.Done <- call
+	}()
+
+	return call
+}
+
+// ping calls Worker.Ping and waits at most timeout for the answer.
+func (worker *RemoteWorker) ping(timeout time.Duration) error {
+	call := worker.goRemoteWorker("Worker.Ping", new(struct{}), new(struct{}), nil)
+
+	select {
+	case <-call.Done:
+		return call.Error
+	case <-time.After(timeout):
+		return errors.New("heartbeat timed out")
+	}
+}
+
+// cancelOperation tells the worker to abandon an attempt of an operation. It doesn't
+// wait for the answer.
+func (worker *RemoteWorker) cancelOperation(args *CancelArgs) {
+	worker.goRemoteWorker("Worker.Cancel", args, new(struct{}), nil)
+}
+
+// connect returns the connection to the worker, dialing it if there's none. Fails if
+// the worker has failed.
+func (worker *RemoteWorker) connect() (*rpc.Client, error) {
+	var (
+		err    error
+		conn   net.Conn
+		client *rpc.Client
+	)
+
+	worker.mutex.Lock()
+	client = worker.client
+	failed := worker.status == WORKER_FAILED
+	worker.mutex.Unlock()
+
+	if failed {
+		return nil, errors.New("worker " + worker.hostname + " has failed")
+	}
+
+	if client != nil {
+		return client, nil
+	}
 
-	if err != nil {
-		return err
+	if conn, err = net.DialTimeout("tcp", worker.hostname, WORKER_DIAL_TIMEOUT); err != nil {
+		return nil, err
 	}
+	client = rpc.NewClient(conn)
 
-	defer client.Close()
+	worker.mutex.Lock()
+	defer worker.mutex.Unlock()
 
-	err = client.Call(proc, args, reply)
+	if worker.status == WORKER_FAILED {
+		client.Close()
+		return nil, errors.New("worker " + worker.hostname + " has failed")
+	}
+
+	// Another call connected in the meantime
+	if worker.client != nil {
+		client.Close()
+		return worker.client, nil
+	}
 
-	if err == io.ErrUnexpectedEOF {
-		time.Sleep(time.Second)
-		var tmpClient *rpc.Client
-		tmpClient, err = rpc.Dial("tcp", worker.hostname)
+	worker.client = client
+	return client, nil
+}
+
+// disconnect drops client if it's still the connection to the worker.
+func (worker *RemoteWorker) disconnect(client *rpc.Client) {
+	worker.mutex.Lock()
+	if worker.client == client {
+		worker.client = nil
+	}
+	worker.mutex.Unlock()
+
+	client.Close()
+}
 
-		if err == nil {
-			// Ignore Unexpected EOF error
-			tmpClient.Close()
-			return nil
+// close closes the connection to the worker once the master is done with it.
+func (worker *RemoteWorker) close() {
+	worker.mutex.Lock()
+	defer worker.mutex.Unlock()
+
+	if worker.client != nil {
+		worker.client.Close()
+		worker.client = nil
+	}
+}
+
+// isConnectionError returns true if err means the worker couldn't be reached or the
+// connection broke, instead of the called procedure returning an error or the caller
+// giving up on it.
+func isConnectionError(err error) bool {
+	if err == nil || errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return false
+	}
+
+	_, serverError := err.(rpc.ServerError)
+	return !serverError
+}
+
+// acquireSlot marks a free slot of the worker as running an operation and returns it.
+// The worker is running while any of its slots is.
+func (worker *RemoteWorker) acquireSlot() int {
+	worker.mutex.Lock()
+	defer worker.mutex.Unlock()
+
+	worker.running++
+	if worker.status != WORKER_FAILED {
+		worker.status = WORKER_RUNNING
+	}
+
+	for slot, busy := range worker.busySlots {
+		if !busy {
+			worker.busySlots[slot] = true
+			return slot
 		}
-		return err
-	} else if err != nil {
-		return err
 	}
 
-	return nil
+	// Only the idle pool hands out slots, so there's always a free one
+	worker.busySlots = append(worker.busySlots, true)
+	return len(worker.busySlots) - 1
+}
+
+// releaseSlot frees a slot returned by acquireSlot. The worker is idle once none of its
+// slots is running.
+func (worker *RemoteWorker) releaseSlot(slot int) {
+	worker.mutex.Lock()
+	defer worker.mutex.Unlock()
+
+	worker.busySlots[slot] = false
+	worker.running--
+	if worker.status != WORKER_FAILED && worker.running == 0 {
+		worker.status = WORKER_IDLE
+	}
+}
+
+// runningSlots returns how many slots of the worker are running an operation.
+func (worker *RemoteWorker) runningSlots() int {
+	worker.mutex.Lock()
+	defer worker.mutex.Unlock()
+
+	return worker.running
+}
+
+// setFailed marks the worker as failed and closes its connection, so the calls in
+// flight return. Returns false if it had already failed.
+func (worker *RemoteWorker) setFailed() bool {
+	worker.mutex.Lock()
+	defer worker.mutex.Unlock()
+
+	if worker.status == WORKER_FAILED {
+		return false
+	}
+
+	worker.status = WORKER_FAILED
+	if worker.client != nil {
+		worker.client.Close()
+		worker.client = nil
+	}
+	return true
+}
+
+func (worker *RemoteWorker) getStatus() workerStatus {
+	worker.mutex.Lock()
+	defer worker.mutex.Unlock()
+
+	return worker.status
+}
+
+func (worker *RemoteWorker) isFailed() bool {
+	worker.mutex.Lock()
+	defer worker.mutex.Unlock()
+
+	return worker.status == WORKER_FAILED
 }
@@ -1,6 +1,8 @@
 package mapreduce
 
 import (
+	"errors"
+	"fmt"
 	"log"
 )
 
@@ -9,19 +11,82 @@ import (
 func (master *Master) Register(args *RegisterArgs, reply *RegisterReply) error {
 	var (
 		newWorker *RemoteWorker
+		slots     int
 	)
-	log.Printf("Registering worker '%v' with hostname '%v'", master.totalWorkers, args.WorkerHostname)
-
 	master.workersMutex.Lock()
 
-	newWorker = &RemoteWorker{master.totalWorkers, args.WorkerHostname, WORKER_IDLE}
+	newWorker = newRemoteWorker(master.totalWorkers, args.WorkerHostname, args.Slots, args.Chunks)
+
+	// The idle pool holds every slot of the registered workers, pushing more would block
+	for _, worker := range master.workers {
+		slots += worker.slots
+	}
+	if slots+newWorker.slots > IDLE_WORKER_BUFFER {
+		master.workersMutex.Unlock()
+		return fmt.Errorf("no room for %v more slots, registered workers have %v of %v", newWorker.slots, slots, IDLE_WORKER_BUFFER)
+	}
+
+	log.Printf("Registering worker '%v' with hostname '%v', %v slots and %v local chunks", master.totalWorkers, args.WorkerHostname, newWorker.slots, len(args.Chunks))
+
 	master.workers[newWorker.id] = newWorker
 	master.totalWorkers++
 
 	master.workersMutex.Unlock()
 
-	master.idleWorkerChan <- newWorker
+	// Every free slot of a worker is an entry in the idle pool
+	for slot := 0; slot < newWorker.slots; slot++ {
+		master.idleWorkerChan <- newWorker
+	}
+
+	go master.monitorWorker(newWorker)
 
 	*reply = RegisterReply{newWorker.id, master.task.NumReduceJobs}
 	return nil
 }
+
+// RPC - SubmitJob
+// Procedure that will be called by clients to queue a new job on this master. The
+// chunks are the input files of the map operations and must be readable by workers.
+func (master *Master) SubmitJob(args *SubmitJobArgs, reply *SubmitJobReply) error {
+	var (
+		err   error
+		jobId int
+	)
+
+	if len(args.Chunks) == 0 {
+		return errors.New("job has no input chunks")
+	}
+
+	if args.ReduceJobs <= 0 {
+		return errors.New("job needs at least one reduce job")
+	}
+
+	if jobId, err = master.submitJob(args.Chunks, args.ReduceJobs, args.Encoding, args.InputFormat); err != nil {
+		return err
+	}
+
+	*reply = SubmitJobReply{jobId}
+	return nil
+}
+
+// RPC - WaitJob
+// Procedure that will be called by clients to wait for a job to be done. Returns the
+// path of its final result file.
+func (master *Master) WaitJob(args *WaitJobArgs, reply *WaitJobReply) error {
+	var (
+		waitedJob *job
+	)
+
+	if waitedJob = master.lookupJob(args.JobId); waitedJob == nil {
+		return fmt.Errorf("job %v not found", args.JobId)
+	}
+
+	<-waitedJob.done
+
+	if waitedJob.err != nil {
+		return fmt.Errorf("job %v stopped: %v", args.JobId, waitedJob.err)
+	}
+
+	*reply = WaitJobReply{finalResultFileName(waitedJob.dir)}
+	return nil
+}
@@ -1,97 +1,417 @@
 package mapreduce
 
 import (
+	"context"
+	"fmt"
 	"log"
-	"sync"
+	"time"
 )
 
-// Schedules map operations on remote workers. This will run until InputFilePathChan
-// is closed. If there is no worker available, it'll block.
-func (master *Master) schedule(task *Task, proc string, filePathChan chan string) int {
+type operationState string
+
+// Operations of a phase go through these states:
+//
+//	pending -> running -> done
+//	              |    \
+//	              v     blocked
+//	           failed -> pending (retry)
+//
+// An operation only fails when its last running attempt fails. While a backup attempt
+// is running the operation stays in running. A reduce operation is blocked when map
+// output it needs was lost, it runs again in the next round of the job.
+const (
+	OPERATION_PENDING operationState = "pending"
+	OPERATION_RUNNING operationState = "running"
+	OPERATION_DONE    operationState = "done"
+	OPERATION_FAILED  operationState = "failed"
+	OPERATION_BLOCKED operationState = "blocked"
+)
+
+// Schedules operations of a phase of job on remote workers. This will run until filePathChan
+// is closed and every operation is done or blocked. Pending operations, including retries of
+// failed ones, are handed out as soon as a worker is idle, map operations preferring
+// workers that hold their input chunk (see master_locality.go). If there is no worker
+// available, it'll block.
+// Operations whose id is in skip were done before the master restarted, they keep
+// their id but aren't run again.
+// If ctx is done first, it returns its cause. Running attempts are then abandoned.
+func (master *Master) schedule(ctx context.Context, task *Task, job *job, proc string, filePathChan chan string, skip map[int]bool) (int, error) {
 	var (
-        wg        sync.WaitGroup
-        worker    *RemoteWorker
-        operation *Operation
-        counter   int
-    )
-
-    log.Printf("Scheduling %v operations\n", proc)
-
-    // Collect all file paths from the channel
-    filePaths := []string{}
-    for filePath := range filePathChan {
-        filePaths = append(filePaths, filePath)
-    }
-
-    // Initialize total operations
-    master.totalOperations = len(filePaths)
-    counter = 0
-
-    // Enqueue initial operations
-    for _, filePath := range filePaths {
-        operation = &Operation{proc, counter, filePath}
-        counter++
-
-        worker = <-master.idleWorkerChan
-        wg.Add(1)
-        go master.runOperation(worker, operation, &wg)
-    }
-
-    // Wait for initial operations to complete
-    wg.Wait()
-
-    // Process failed operations until all are successful
-    for {
-        master.operationsMutex.Lock()
-        if master.successOperations >= master.totalOperations {
-            master.operationsMutex.Unlock()
-            break
-        }
-        master.operationsMutex.Unlock()
-
-        // Get a failed operation to retry
-        failedOp := <-master.failedOperationsChan
-        worker = <-master.idleWorkerChan
-        wg.Add(1)
-        go master.runOperation(worker, failedOp, &wg)
-
-        // Wait for the retried operation to complete
-        wg.Wait()
-    }
-
-    log.Printf("%vx %v operations completed\n", counter, proc)
-    return counter
+		operation  *Operation
+		pending    []*Operation
+		worker     *RemoteWorker
+		held       []*RemoteWorker // idle workers waiting for an operation local to them
+		idleWorker chan *RemoteWorker
+		wakeup     <-chan time.Time
+		counter    int
+		stop       chan struct{}
+		start      time.Time
+	)
+
+	log.Printf("Scheduling %v operations of job %v\n", proc, job.id)
+
+	// Collect all operations of the phase from the channel
+	pending = make([]*Operation, 0)
+	for filePath := range filePathChan {
+		if !skip[counter] {
+			operation = &Operation{job: job, proc: proc, id: counter, filePath: filePath, state: OPERATION_PENDING, pendingSince: time.Now()}
+			pending = append(pending, operation)
+		}
+		counter++
+	}
+
+	if len(pending) < counter {
+		log.Printf("Skipping %v %v operations done before restart\n", counter-len(pending), proc)
+	}
+
+	master.startPhase(job, proc, pending)
+	start = time.Now()
+
+	// Once every operation has been handed out, stragglers get a backup attempt if the
+	// task enables it.
+	stop = make(chan struct{})
+	if task.Speculative {
+		go master.speculate(ctx, task, stop)
+	}
+	defer close(stop)
+
+	// Workers still held when the phase is over go back to the idle pool
+	defer func() {
+		for _, worker := range held {
+			master.idleWorkerChan <- worker
+		}
+	}()
+
+	for !master.phaseDone() {
+		held, pending = master.assignOperations(ctx, task, proc, held, pending)
+
+		// Only wait for workers when there's something to run, and for the locality
+		// delay when workers are held
+		idleWorker, wakeup = nil, nil
+		if len(pending) > 0 {
+			idleWorker = master.idleWorkerChan
+			if len(held) > 0 {
+				wakeup = time.After(localityWait(task, pending))
+			}
+		}
+
+		select {
+		case worker = <-idleWorker:
+			if !worker.isFailed() {
+				held = append(held, worker)
+			}
+
+		case <-wakeup:
+
+		case operation = <-master.failedOperationsChan:
+			if operation.job != job || operation.proc != proc {
+				// Left over by a previous phase or job, nothing to retry
+				continue
+			}
+			master.retryOperation(operation)
+			operation.pendingSince = time.Now()
+			pending = append(pending, operation)
+
+		case <-master.operationDoneChan:
+
+		case <-ctx.Done():
+			log.Printf("Stopped scheduling %v operations (%v)\n", proc, master.phaseSummary())
+			job.trace.phase(proc, start, time.Now(), "stopped: "+master.phaseSummary())
+			return counter, context.Cause(ctx)
+		}
+	}
+
+	log.Printf("%vx %v operations completed (%v)\n", counter, proc, master.phaseSummary())
+	master.metrics.phases.observe(proc, time.Since(start).Seconds())
+	job.trace.phase(proc, start, time.Now(), master.phaseSummary())
+	return counter, nil
 }
 
-// runOperation start a single operation on a RemoteWorker and wait for it to return or fail.
-func (master *Master) runOperation(remoteWorker *RemoteWorker, operation *Operation, wg *sync.WaitGroup) {
-	defer wg.Done() // Ensure Done is called regardless of success or failure
+// runOperation start a single attempt of an operation on a RemoteWorker and wait for it
+// to return or fail. An attempt that doesn't return within task.OperationTimeout, or
+// before ctx is done, fails and the worker is told to abandon it. Its slot is only
+// freed once the worker returns from it.
+func (master *Master) runOperation(ctx context.Context, task *Task, remoteWorker *RemoteWorker, operation *Operation, backup bool) {
+	var (
+		err     error
+		args    *RunArgs
+		reply   *RunReply
+		attempt int
+		start   time.Time
+		opCtx   context.Context
+		cancel  context.CancelFunc
+		outcome string
+		slot    int
+	)
+
+	attempt = master.startAttempt(operation, backup, remoteWorker)
+	start = time.Now()
+
+	defer func() {
+		operation.job.trace.attempt(operation, attempt, remoteWorker, slot, backup, start, time.Now(), outcome)
+	}()
+
+	if task.OperationTimeout > 0 {
+		opCtx, cancel = context.WithTimeout(ctx, task.OperationTimeout)
+	} else {
+		opCtx, cancel = context.WithCancel(ctx)
+	}
+	defer cancel()
+
+	log.Printf("Running %v (ID: '%v' File: '%v' Worker: '%v' Attempt: '%v')\n", operation.proc, operation.id, operation.filePath, remoteWorker.id, attempt)
+
+	slot = remoteWorker.acquireSlot()
+
+	args = &RunArgs{
+		JobId:      operation.job.id,
+		JobToken:   operation.job.state.token,
+		ReduceJobs: operation.job.state.reduceJobs,
+		Id:         operation.id,
+		FilePath:   operation.filePath,
+		Attempt:    attempt,
+		Encoding:   operation.job.state.encoding,
 
-    var (
-        err  error
-        args *RunArgs
-    )
+		Partitioning: task.Partitioning,
+	}
+	if operation.proc == "Worker.RunMap" {
+		args.SplitPoints = operation.job.state.splitPoints
+		args.InputFormat = operation.job.state.inputFormat
+	}
+	if operation.proc == "Worker.RunReduce" {
+		args.MapWorkers = master.mapWorkers(operation.job)
+	}
 
-    log.Printf("Running %v (ID: '%v' File: '%v' Worker: '%v')\n", operation.proc, operation.id, operation.filePath, remoteWorker.id)
+	// The call is kept to know when the worker is done with the attempt
+	reply = new(RunReply)
+	call := remoteWorker.goRemoteWorker(operation.proc, args, reply, nil)
+	select {
+	case <-call.Done:
+		err = call.Error
+	case <-opCtx.Done():
+		err = opCtx.Err()
+	}
 
-    args = &RunArgs{operation.id, operation.filePath}
-    err = remoteWorker.callRemoteWorker(operation.proc, args, new(struct{}))
+	// The result of a reduce operation stays with its worker until it's fetched
+	if err == nil && operation.proc == "Worker.RunReduce" && len(reply.LostMaps) == 0 {
+		err = master.fetchResult(opCtx, remoteWorker, operation, attempt)
+	}
+
+	if err != nil {
+		log.Printf("Operation %v '%v' Failed. Error: %v\n", operation.proc, operation.id, err)
+		master.metrics.failed.inc(operation.proc)
+
+		if opCtx.Err() != nil {
+			// Timed out or cancelled. The worker is still there but must stop working
+			// on the attempt. Its slot stays busy until the attempt returns, a hung
+			// function keeps running on the worker.
+			outcome = ATTEMPT_CANCELLED
+			remoteWorker.cancelOperation(&CancelArgs{JobId: args.JobId, Proc: operation.proc, Id: args.Id, Attempt: attempt})
+			go func() {
+				<-call.Done
+				master.releaseSlot(remoteWorker, slot)
+			}()
+		} else if isFatalError(err) {
+			// Running the operation again won't help, the whole job fails
+			outcome = ATTEMPT_FAILED
+			operation.job.abort(fmt.Errorf("%v %v (file '%v') failed on worker '%v' and can't be retried: %v",
+				phaseName(operation.proc), operation.id, operation.filePath, remoteWorker.hostname, err))
+			master.releaseSlot(remoteWorker, slot)
+		} else if isConnectionError(err) {
+			// Send the failed worker to be handled, unless its heartbeats already did
+			outcome = ATTEMPT_WORKER_FAILED
+			remoteWorker.releaseSlot(slot)
+			master.failWorker(remoteWorker)
+		} else {
+			// Only the operation failed, the worker can run another one
+			outcome = ATTEMPT_FAILED
+			master.releaseSlot(remoteWorker, slot)
+		}
+
+		// Re-enqueue the failed operation, unless another attempt is still running or
+		// the whole phase was cancelled
+		if master.attemptFailed(operation) && ctx.Err() == nil {
+			master.failedOperationsChan <- operation
+		}
+	} else {
+		// Return the slot to the idle pool
+		master.releaseSlot(remoteWorker, slot)
+
+		if len(reply.LostMaps) > 0 {
+			log.Printf("Operation %v '%v' is blocked on lost output of map operations %v.\n", operation.proc, operation.id, reply.LostMaps)
+			outcome = ATTEMPT_BLOCKED
+			master.mapOutputsLost(operation.job, reply.LostMaps)
+			if master.attemptBlocked(operation) {
+				master.notifyOperationDone()
+			}
+			return
+		}
+
+		// Only the first attempt to finish counts, the output of the others is ignored
+		if master.attemptSucceeded(operation, time.Since(start)) {
+			outcome = ATTEMPT_SUCCEEDED
+			master.operationDone(operation, remoteWorker, reply.Counters)
+			master.notifyOperationDone()
+		} else {
+			outcome = ATTEMPT_DISCARDED
+			log.Printf("Ignoring attempt %v of %v '%v', operation already completed.\n", attempt, operation.proc, operation.id)
+		}
+	}
+}
+
+// releaseSlot frees a slot of remoteWorker and returns it to the idle pool, unless
+// the worker failed in the meantime.
+func (master *Master) releaseSlot(remoteWorker *RemoteWorker, slot int) {
+	remoteWorker.releaseSlot(slot)
+	if !remoteWorker.isFailed() {
+		master.idleWorkerChan <- remoteWorker
+	}
+}
 
-    if err != nil {
-        log.Printf("Operation %v '%v' Failed. Error: %v\n", operation.proc, operation.id, err)
+// startPhase resets the operations and counters of the master for a new phase, made of
+// the proc operations of job.
+func (master *Master) startPhase(job *job, proc string, operations []*Operation) {
+	master.operationsMutex.Lock()
+	defer master.operationsMutex.Unlock()
+
+	master.phaseJob = job
+	master.phaseProc = proc
+	master.phaseStart = time.Now()
+	master.operations = operations
+	master.durations = make([]time.Duration, 0, len(operations))
+	master.totalOperations = len(operations)
+	master.successOperations = 0
+	master.retriedOperations = 0
+	master.blockedOperations = 0
+	master.localOperations = 0
+	master.remoteOperations = 0
+}
+
+// phaseDone returns true when every operation of the current phase is done or blocked.
+func (master *Master) phaseDone() bool {
+	master.operationsMutex.Lock()
+	defer master.operationsMutex.Unlock()
+
+	return master.successOperations+master.blockedOperations >= master.totalOperations
+}
+
+// phaseSummary describes how the operations of the current phase went.
+func (master *Master) phaseSummary() string {
+	var attempts int
+
+	master.operationsMutex.Lock()
+	defer master.operationsMutex.Unlock()
+
+	for _, operation := range master.operations {
+		attempts += operation.attempts
+	}
+
+	summary := fmt.Sprintf("%v done, %v attempts, %v retried, %v blocked", master.successOperations, attempts, master.retriedOperations, master.blockedOperations)
+	if master.phaseProc == "Worker.RunMap" {
+		summary += fmt.Sprintf(", %v data-local, %v remote", master.localOperations, master.remoteOperations)
+	}
+	return summary
+}
+
+// notifyOperationDone wakes up the scheduler so it checks if the phase is done. A
+// pending notification is enough, so it never blocks.
+func (master *Master) notifyOperationDone() {
+	select {
+	case master.operationDoneChan <- struct{}{}:
+	default:
+	}
+}
+
+func (master *Master) setOperationState(operation *Operation, state operationState) {
+	master.operationsMutex.Lock()
+	defer master.operationsMutex.Unlock()
+
+	operation.state = state
+}
+
+// retryOperation moves a failed operation back to pending.
+func (master *Master) retryOperation(operation *Operation) {
+	master.operationsMutex.Lock()
+	defer master.operationsMutex.Unlock()
+
+	operation.state = OPERATION_PENDING
+	operation.backup = false
+	master.retriedOperations++
+	master.metrics.retried.inc(operation.proc)
+}
+
+// startAttempt records a new attempt of operation on remoteWorker and returns its number.
+func (master *Master) startAttempt(operation *Operation, backup bool, remoteWorker *RemoteWorker) int {
+	master.operationsMutex.Lock()
+	defer master.operationsMutex.Unlock()
+
+	operation.worker = remoteWorker.hostname
+	if operation.proc == "Worker.RunMap" {
+		if remoteWorker.hasChunk(operation.filePath) {
+			master.localOperations++
+			master.metrics.local.inc(operation.proc)
+		} else {
+			master.remoteOperations++
+			master.metrics.remote.inc(operation.proc)
+		}
+	}
+
+	if backup {
+		operation.backup = true
+	} else {
+		operation.startTime = time.Now()
+	}
+
+	operation.running++
+	operation.attempts++
+	master.metrics.started.inc(operation.proc)
+	return operation.attempts - 1
+}
+
+// attemptFailed returns true if the operation failed: it isn't done and no other
+// attempt of it is still running.
+func (master *Master) attemptFailed(operation *Operation) bool {
+	master.operationsMutex.Lock()
+	defer master.operationsMutex.Unlock()
+
+	operation.running--
+	if operation.state != OPERATION_RUNNING || operation.running > 0 {
+		return false
+	}
+
+	operation.state = OPERATION_FAILED
+	return true
+}
+
+// attemptBlocked returns true if the operation is blocked: it isn't done and no other
+// attempt of it is still running.
+func (master *Master) attemptBlocked(operation *Operation) bool {
+	master.operationsMutex.Lock()
+	defer master.operationsMutex.Unlock()
+
+	operation.running--
+	if operation.state != OPERATION_RUNNING || operation.running > 0 {
+		return false
+	}
+
+	operation.state = OPERATION_BLOCKED
+	master.blockedOperations++
+	return true
+}
 
-        // Send the failed worker to be handled
-        master.failedWorkerChan <- remoteWorker
+// attemptSucceeded returns true if this is the first attempt of operation to finish.
+func (master *Master) attemptSucceeded(operation *Operation, duration time.Duration) bool {
+	master.operationsMutex.Lock()
+	defer master.operationsMutex.Unlock()
 
-        // Re-enqueue the failed operation
-        master.failedOperationsChan <- operation
-    } else {
-        // Return the worker to the idle pool
-        master.idleWorkerChan <- remoteWorker
+	operation.running--
+	if operation.state == OPERATION_DONE {
+		return false
+	}
 
-        // Increment the count of successful operations safely
-        master.operationsMutex.Lock()
-        master.successOperations++
-        master.operationsMutex.Unlock()
-    }
+	operation.state = OPERATION_DONE
+	operation.duration = duration
+	master.successOperations++
+	master.metrics.succeeded.inc(operation.proc)
+	master.durations = append(master.durations, duration)
+	return true
 }
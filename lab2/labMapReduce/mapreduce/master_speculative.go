@@ -0,0 +1,125 @@
+package mapreduce
+
+import (
+	"context"
+	"log"
+	"time"
+)
+
+const (
+	SPECULATIVE_SLOWDOWN       = 1.5
+	SPECULATIVE_CHECK_INTERVAL = 500 * time.Millisecond
+)
+
+// speculate runs until stop is closed, looking for straggler operations of the
+// current phase once none of them is pending. An operation is a straggler when its
+// attempt has been running for longer than task.SpeculativeSlowdown times the mean
+// duration of the operations that already completed. Each straggler gets at most one
+// backup attempt, started on an idle worker.
+func (master *Master) speculate(ctx context.Context, task *Task, stop chan struct{}) {
+	var (
+		ticker   *time.Ticker
+		slowdown float64
+	)
+
+	slowdown = task.SpeculativeSlowdown
+	if slowdown <= 0 {
+		slowdown = SPECULATIVE_SLOWDOWN
+	}
+
+	ticker = time.NewTicker(SPECULATIVE_CHECK_INTERVAL)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+
+		for _, operation := range master.stragglers(slowdown) {
+			worker := master.tryIdleWorker()
+			if worker == nil {
+				break
+			}
+
+			if !master.reserveBackup(operation, worker) {
+				master.idleWorkerChan <- worker
+				continue
+			}
+
+			log.Printf("Operation %v '%v' is a straggler. Starting backup attempt.\n", operation.proc, operation.id)
+			go master.runOperation(ctx, task, worker, operation, true)
+		}
+	}
+}
+
+// stragglers returns the operations of the current phase that should get a backup
+// attempt.
+func (master *Master) stragglers(slowdown float64) (operations []*Operation) {
+	var (
+		mean      time.Duration
+		threshold time.Duration
+	)
+
+	master.operationsMutex.Lock()
+	defer master.operationsMutex.Unlock()
+
+	if len(master.durations) == 0 {
+		return nil
+	}
+
+	// Backups only make sense near the end of the phase, when every operation has
+	// been handed out and workers would otherwise sit idle.
+	for _, operation := range master.operations {
+		if operation.state == OPERATION_PENDING || operation.state == OPERATION_FAILED {
+			return nil
+		}
+	}
+
+	for _, duration := range master.durations {
+		mean += duration
+	}
+	mean /= time.Duration(len(master.durations))
+	threshold = time.Duration(float64(mean) * slowdown)
+
+	for _, operation := range master.operations {
+		if operation.state != OPERATION_RUNNING || operation.backup || operation.running != 1 {
+			continue
+		}
+
+		if time.Since(operation.startTime) > threshold {
+			operations = append(operations, operation)
+		}
+	}
+	return operations
+}
+
+// reserveBackup marks operation as having a backup attempt on worker. Returns false if
+// it completed or got one in the meantime, or if worker is the one running it: a slot
+// of the same worker would be as slow as the attempt it backs up.
+func (master *Master) reserveBackup(operation *Operation, worker *RemoteWorker) bool {
+	master.operationsMutex.Lock()
+	defer master.operationsMutex.Unlock()
+
+	if operation.state != OPERATION_RUNNING || operation.backup || operation.worker == worker.hostname {
+		return false
+	}
+
+	operation.backup = true
+	return true
+}
+
+// tryIdleWorker returns an idle worker if one is available right away, nil otherwise.
+func (master *Master) tryIdleWorker() *RemoteWorker {
+	for {
+		select {
+		case worker := <-master.idleWorkerChan:
+			if !worker.isFailed() {
+				return worker
+			}
+		default:
+			return nil
+		}
+	}
+}
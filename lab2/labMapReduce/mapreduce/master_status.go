@@ -0,0 +1,320 @@
+package mapreduce
+
+import (
+	"encoding/json"
+	"html/template"
+	"log"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+)
+
+const (
+	STATUS_REFRESH_INTERVAL = 2 // seconds between reloads of the dashboard
+)
+
+// The status server answers with snapshots of the master:
+//
+//	/                   HTML dashboard, reloaded every STATUS_REFRESH_INTERVAL
+//	/status             everything below in a single document
+//	/status/jobs        jobs and how many of their operations are done
+//	/status/phase       current phase and every one of its operations
+//	/status/workers     registered workers and their workerStatus
+//	/metrics            metrics in the Prometheus text format, see metrics.go
+//
+// Snapshots are taken under the same mutexes the scheduler uses, so counters and
+// operation states always agree with each other.
+
+type jobStatusView struct {
+	Id         int    `json:"id"`
+	Phase      string `json:"phase"` // queued, map, reduce, done or failed
+	Error      string `json:"error,omitempty"`
+	MapDone    int    `json:"mapDone"`
+	MapTotal   int    `json:"mapTotal"`
+	ReduceDone int    `json:"reduceDone"`
+	ReduceJobs int    `json:"reduceJobs"`
+}
+
+type operationStatusView struct {
+	Id       int            `json:"id"`
+	FilePath string         `json:"filePath"`
+	State    operationState `json:"state"`
+	Worker   string         `json:"worker,omitempty"`
+	Attempts int            `json:"attempts"`
+	Running  int            `json:"running"`
+	Backup   bool           `json:"backup"`
+	Duration string         `json:"duration,omitempty"` // run time so far while running
+}
+
+type phaseStatusView struct {
+	JobId      int                   `json:"jobId"`
+	Proc       string                `json:"proc"`
+	Elapsed    string                `json:"elapsed"`
+	Total      int                   `json:"total"`
+	Succeeded  int                   `json:"succeeded"`
+	Retried    int                   `json:"retried"`
+	Blocked    int                   `json:"blocked"`
+	Local      int                   `json:"local"`  // map attempts started on a worker holding their chunk
+	Remote     int                   `json:"remote"` // map attempts started on any other
+	Operations []operationStatusView `json:"operations"`
+}
+
+type workerStatusView struct {
+	Id       int          `json:"id"`
+	Hostname string       `json:"hostname"`
+	Status   workerStatus `json:"status"`
+	Slots    int          `json:"slots"`
+	Running  int          `json:"running"` // slots running an operation
+}
+
+type masterStatusView struct {
+	Address string             `json:"address"`
+	Time    time.Time          `json:"time"`
+	Jobs    []jobStatusView    `json:"jobs"`
+	Phase   *phaseStatusView   `json:"phase"` // nil before the first phase
+	Workers []workerStatusView `json:"workers"`
+}
+
+// startStatusServer serves the status of the master over HTTP on address until the
+// master stops. Failing to listen only disables the status server.
+func (master *Master) startStatusServer(address string) {
+	var (
+		err      error
+		listener net.Listener
+		mux      *http.ServeMux
+	)
+
+	if listener, err = net.Listen("tcp", address); err != nil {
+		log.Println("Failed to start status server. Error:", err)
+		return
+	}
+
+	mux = http.NewServeMux()
+	mux.HandleFunc("/", master.handleDashboard)
+	mux.HandleFunc("/status", master.handleStatus(func() interface{} { return master.status() }))
+	mux.HandleFunc("/status/jobs", master.handleStatus(func() interface{} { return master.jobsStatus() }))
+	mux.HandleFunc("/status/phase", master.handleStatus(func() interface{} { return master.phaseStatus() }))
+	mux.HandleFunc("/status/workers", master.handleStatus(func() interface{} { return master.workersStatus() }))
+	mux.HandleFunc("/metrics", metricsHandler(master.metricsList()...))
+
+	master.statusServer = &http.Server{Handler: mux}
+
+	log.Printf("Serving status on http://%v/\n", listener.Addr())
+
+	go func() {
+		if err := master.statusServer.Serve(listener); err != http.ErrServerClosed {
+			log.Println("Status server stopped. Error:", err)
+		}
+	}()
+}
+
+// stopStatusServer closes the status server, if there's one.
+func (master *Master) stopStatusServer() {
+	if master.statusServer != nil {
+		master.statusServer.Close()
+	}
+}
+
+// handleStatus returns a handler that writes the snapshot taken by view as JSON.
+func (master *Master) handleStatus(view func() interface{}) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+
+		encoder := json.NewEncoder(w)
+		encoder.SetIndent("", "  ")
+		if err := encoder.Encode(view()); err != nil {
+			log.Println("Failed to write status. Error:", err)
+		}
+	}
+}
+
+func (master *Master) handleDashboard(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != "/" {
+		http.NotFound(w, r)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	if err := dashboardTemplate.Execute(w, master.status()); err != nil {
+		log.Println("Failed to write dashboard. Error:", err)
+	}
+}
+
+// status returns a snapshot of everything served by the status server.
+func (master *Master) status() *masterStatusView {
+	return &masterStatusView{
+		Address: master.address,
+		Time:    time.Now(),
+		Jobs:    master.jobsStatus(),
+		Phase:   master.phaseStatus(),
+		Workers: master.workersStatus(),
+	}
+}
+
+// jobsStatus returns a snapshot of every job known to the master, ordered by id.
+func (master *Master) jobsStatus() []jobStatusView {
+	var (
+		jobs  []*job
+		views []jobStatusView
+	)
+
+	master.jobsMutex.Lock()
+	jobs = make([]*job, 0, len(master.jobs))
+	for _, j := range master.jobs {
+		jobs = append(jobs, j)
+	}
+	master.jobsMutex.Unlock()
+
+	sort.Slice(jobs, func(i, k int) bool { return jobs[i].id < jobs[k].id })
+
+	master.operationsMutex.Lock()
+	defer master.operationsMutex.Unlock()
+
+	views = make([]jobStatusView, 0, len(jobs))
+	for _, j := range jobs {
+		view := jobStatusView{
+			Id:         j.id,
+			Phase:      "queued",
+			MapDone:    len(j.state.mapDone),
+			MapTotal:   len(j.state.chunks),
+			ReduceDone: len(j.state.reduceDone),
+			ReduceJobs: j.state.reduceJobs,
+		}
+
+		select {
+		case <-j.done:
+			view.Phase = "done"
+			if j.err != nil {
+				view.Phase = "failed"
+				view.Error = j.err.Error()
+			}
+		default:
+			if master.phaseJob == j {
+				view.Phase = phaseName(master.phaseProc)
+			}
+		}
+
+		views = append(views, view)
+	}
+	return views
+}
+
+// phaseStatus returns a snapshot of the current phase, or nil if none started yet.
+func (master *Master) phaseStatus() *phaseStatusView {
+	var view *phaseStatusView
+
+	master.operationsMutex.Lock()
+	defer master.operationsMutex.Unlock()
+
+	if master.phaseJob == nil {
+		return nil
+	}
+
+	view = &phaseStatusView{
+		JobId:      master.phaseJob.id,
+		Proc:       master.phaseProc,
+		Elapsed:    time.Since(master.phaseStart).Round(time.Millisecond).String(),
+		Total:      master.totalOperations,
+		Succeeded:  master.successOperations,
+		Retried:    master.retriedOperations,
+		Blocked:    master.blockedOperations,
+		Local:      master.localOperations,
+		Remote:     master.remoteOperations,
+		Operations: make([]operationStatusView, 0, len(master.operations)),
+	}
+
+	for _, operation := range master.operations {
+		operationView := operationStatusView{
+			Id:       operation.id,
+			FilePath: operation.filePath,
+			State:    operation.state,
+			Worker:   operation.worker,
+			Attempts: operation.attempts,
+			Running:  operation.running,
+			Backup:   operation.backup,
+		}
+
+		switch operation.state {
+		case OPERATION_DONE:
+			operationView.Duration = operation.duration.Round(time.Millisecond).String()
+		case OPERATION_RUNNING:
+			operationView.Duration = time.Since(operation.startTime).Round(time.Millisecond).String()
+		}
+
+		view.Operations = append(view.Operations, operationView)
+	}
+
+	sort.Slice(view.Operations, func(i, k int) bool { return view.Operations[i].Id < view.Operations[k].Id })
+	return view
+}
+
+// workersStatus returns a snapshot of the registered workers, ordered by id.
+func (master *Master) workersStatus() []workerStatusView {
+	var views []workerStatusView
+
+	master.workersMutex.Lock()
+	defer master.workersMutex.Unlock()
+
+	views = make([]workerStatusView, 0, len(master.workers))
+	for _, worker := range master.workers {
+		views = append(views, workerStatusView{Id: worker.id, Hostname: worker.hostname, Status: worker.getStatus(), Slots: worker.slots, Running: worker.runningSlots()})
+	}
+
+	sort.Slice(views, func(i, k int) bool { return views[i].Id < views[k].Id })
+	return views
+}
+
+// phaseName returns the name of the phase made of proc operations.
+func phaseName(proc string) string {
+	switch proc {
+	case "Worker.RunMap":
+		return "map"
+	case "Worker.RunReduce":
+		return "reduce"
+	}
+	return proc
+}
+
+var dashboardTemplate = template.Must(template.New("dashboard").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<meta http-equiv="refresh" content="` + strconv.Itoa(STATUS_REFRESH_INTERVAL) + `">
+<title>MapReduce master {{.Address}}</title>
+<style>
+body { font-family: sans-serif; margin: 2em; }
+table { border-collapse: collapse; margin-bottom: 2em; }
+th, td { border: 1px solid #ccc; padding: 0.2em 0.6em; text-align: left; }
+.done, .idle { color: green; }
+.running { color: #b58900; }
+.failed, .blocked { color: red; }
+</style>
+</head>
+<body>
+<h1>MapReduce master {{.Address}}</h1>
+<p>Updated {{.Time.Format "15:04:05"}}. <a href="/status">JSON</a></p>
+
+<h2>Jobs</h2>
+<table>
+<tr><th>Id</th><th>Phase</th><th>Map</th><th>Reduce</th><th>Error</th></tr>
+{{range .Jobs}}<tr><td>{{.Id}}</td><td class="{{.Phase}}">{{.Phase}}</td><td>{{.MapDone}}/{{.MapTotal}}</td><td>{{.ReduceDone}}/{{.ReduceJobs}}</td><td>{{.Error}}</td></tr>
+{{end}}</table>
+
+<h2>Phase</h2>
+{{with .Phase}}<p>Job {{.JobId}}, {{.Proc}}: {{.Succeeded}}/{{.Total}} done, {{.Retried}} retried, {{.Blocked}} blocked, {{.Local}} data-local and {{.Remote}} remote attempts, running for {{.Elapsed}}.</p>
+<table>
+<tr><th>Id</th><th>State</th><th>Worker</th><th>Attempts</th><th>Running</th><th>Backup</th><th>Duration</th><th>File</th></tr>
+{{range .Operations}}<tr><td>{{.Id}}</td><td class="{{.State}}">{{.State}}</td><td>{{.Worker}}</td><td>{{.Attempts}}</td><td>{{.Running}}</td><td>{{.Backup}}</td><td>{{.Duration}}</td><td>{{.FilePath}}</td></tr>
+{{end}}</table>
+{{else}}<p>No phase started yet.</p>
+{{end}}
+<h2>Workers</h2>
+<table>
+<tr><th>Id</th><th>Hostname</th><th>Status</th><th>Slots</th></tr>
+{{range .Workers}}<tr><td>{{.Id}}</td><td>{{.Hostname}}</td><td class="{{.Status}}">{{.Status}}</td><td>{{.Running}}/{{.Slots}}</td></tr>
+{{end}}</table>
+</body>
+</html>
+`))
@@ -0,0 +1,276 @@
+package mapreduce
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Metrics are exposed in the Prometheus text format, version 0.0.4:
+// https://prometheus.io/docs/instrumenting/exposition_formats/
+// Every metric has at most one label, the RPC procedure of the operations it measures.
+
+const (
+	METRICS_CONTENT_TYPE = "text/plain; version=0.0.4; charset=utf-8"
+)
+
+var (
+	// Upper bounds of the buckets of the histograms, in seconds
+	OPERATION_SECONDS_BUCKETS = []float64{0.01, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30, 60}
+	PHASE_SECONDS_BUCKETS     = []float64{0.1, 0.5, 1, 5, 10, 30, 60, 300, 600, 1800}
+)
+
+// metric is written in the exposition format by writeMetrics.
+type metric interface {
+	write(w io.Writer)
+}
+
+// counterVec is a counter for every value of its label.
+type counterVec struct {
+	name  string
+	help  string
+	label string
+
+	mutex  sync.Mutex
+	values map[string]float64
+}
+
+func newCounterVec(name string, help string, label string) *counterVec {
+	return &counterVec{name: name, help: help, label: label, values: make(map[string]float64)}
+}
+
+func (counter *counterVec) add(labelValue string, value float64) {
+	counter.mutex.Lock()
+	defer counter.mutex.Unlock()
+
+	counter.values[labelValue] += value
+}
+
+func (counter *counterVec) inc(labelValue string) {
+	counter.add(labelValue, 1)
+}
+
+func (counter *counterVec) write(w io.Writer) {
+	counter.mutex.Lock()
+	defer counter.mutex.Unlock()
+
+	writeHeader(w, counter.name, counter.help, "counter")
+	for _, labelValue := range sortedKeys(counter.values) {
+		fmt.Fprintf(w, "%v%v %v\n", counter.name, labels(counter.label, labelValue), formatValue(counter.values[labelValue]))
+	}
+}
+
+// gaugeFunc is a gauge whose value is read when the metrics are scraped.
+type gaugeFunc struct {
+	name  string
+	help  string
+	value func() float64
+}
+
+func (gauge *gaugeFunc) write(w io.Writer) {
+	writeHeader(w, gauge.name, gauge.help, "gauge")
+	fmt.Fprintf(w, "%v %v\n", gauge.name, formatValue(gauge.value()))
+}
+
+// histogramVec is a histogram for every value of its label.
+type histogramVec struct {
+	name    string
+	help    string
+	label   string
+	buckets []float64
+
+	mutex  sync.Mutex
+	series map[string]*histogram
+}
+
+type histogram struct {
+	counts []uint64 // observations in each bucket, not cumulative
+	sum    float64
+	count  uint64
+}
+
+func newHistogramVec(name string, help string, label string, buckets []float64) *histogramVec {
+	return &histogramVec{name: name, help: help, label: label, buckets: buckets, series: make(map[string]*histogram)}
+}
+
+func (vec *histogramVec) observe(labelValue string, value float64) {
+	vec.mutex.Lock()
+	defer vec.mutex.Unlock()
+
+	h := vec.series[labelValue]
+	if h == nil {
+		h = &histogram{counts: make([]uint64, len(vec.buckets))}
+		vec.series[labelValue] = h
+	}
+
+	// Values above every bucket are only counted by +Inf
+	if b := sort.SearchFloat64s(vec.buckets, value); b < len(vec.buckets) {
+		h.counts[b]++
+	}
+	h.sum += value
+	h.count++
+}
+
+func (vec *histogramVec) write(w io.Writer) {
+	vec.mutex.Lock()
+	defer vec.mutex.Unlock()
+
+	writeHeader(w, vec.name, vec.help, "histogram")
+	for _, labelValue := range sortedKeys(vec.series) {
+		var (
+			h          = vec.series[labelValue]
+			cumulative uint64
+		)
+
+		for b, bound := range vec.buckets {
+			cumulative += h.counts[b]
+			fmt.Fprintf(w, "%v_bucket%v %v\n", vec.name, labels(vec.label, labelValue, "le", formatValue(bound)), cumulative)
+		}
+		fmt.Fprintf(w, "%v_bucket%v %v\n", vec.name, labels(vec.label, labelValue, "le", "+Inf"), h.count)
+		fmt.Fprintf(w, "%v_sum%v %v\n", vec.name, labels(vec.label, labelValue), formatValue(h.sum))
+		fmt.Fprintf(w, "%v_count%v %v\n", vec.name, labels(vec.label, labelValue), h.count)
+	}
+}
+
+// writeMetrics writes every metric to w in the exposition format.
+func writeMetrics(w io.Writer, metrics ...metric) {
+	for _, m := range metrics {
+		m.write(w)
+	}
+}
+
+// metricsHandler serves metrics on /metrics.
+func metricsHandler(metrics ...metric) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", METRICS_CONTENT_TYPE)
+		writeMetrics(w, metrics...)
+	}
+}
+
+// serveMetrics serves metrics over HTTP on address in the background. Failing to
+// listen only disables them.
+func serveMetrics(address string, metrics ...metric) *http.Server {
+	var (
+		err      error
+		listener net.Listener
+		mux      *http.ServeMux
+		server   *http.Server
+	)
+
+	if listener, err = net.Listen("tcp", address); err != nil {
+		log.Println("Failed to start metrics server. Error:", err)
+		return nil
+	}
+
+	mux = http.NewServeMux()
+	mux.HandleFunc("/metrics", metricsHandler(metrics...))
+	server = &http.Server{Handler: mux}
+
+	log.Printf("Serving metrics on http://%v/metrics\n", listener.Addr())
+
+	go func() {
+		if err := server.Serve(listener); err != http.ErrServerClosed {
+			log.Println("Metrics server stopped. Error:", err)
+		}
+	}()
+	return server
+}
+
+func writeHeader(w io.Writer, name string, help string, kind string) {
+	fmt.Fprintf(w, "# HELP %v %v\n", name, strings.NewReplacer(`\`, `\\`, "\n", `\n`).Replace(help))
+	fmt.Fprintf(w, "# TYPE %v %v\n", name, kind)
+}
+
+// labels formats pairs of label names and values, skipping labels without a name.
+func labels(pairs ...string) string {
+	var parts []string
+
+	escape := strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+	for i := 0; i+1 < len(pairs); i += 2 {
+		if pairs[i] != "" {
+			parts = append(parts, fmt.Sprintf(`%v="%v"`, pairs[i], escape.Replace(pairs[i+1])))
+		}
+	}
+
+	if len(parts) == 0 {
+		return ""
+	}
+	return "{" + strings.Join(parts, ",") + "}"
+}
+
+func formatValue(value float64) string {
+	return strconv.FormatFloat(value, 'g', -1, 64)
+}
+
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// masterMetrics are the metrics of the operations scheduled by a master.
+type masterMetrics struct {
+	started   *counterVec
+	succeeded *counterVec
+	failed    *counterVec
+	retried   *counterVec
+	local     *counterVec
+	remote    *counterVec
+	phases    *histogramVec
+}
+
+func newMasterMetrics() *masterMetrics {
+	return &masterMetrics{
+		started:   newCounterVec("mapreduce_master_operations_started_total", "Attempts of operations started, backups included.", "proc"),
+		succeeded: newCounterVec("mapreduce_master_operations_succeeded_total", "Operations completed by their first attempt to finish.", "proc"),
+		failed:    newCounterVec("mapreduce_master_operations_failed_total", "Attempts of operations that failed or timed out.", "proc"),
+		retried:   newCounterVec("mapreduce_master_operations_retried_total", "Failed operations scheduled again.", "proc"),
+		local:     newCounterVec("mapreduce_master_operations_local_total", "Attempts of map operations started on a worker holding their input chunk.", "proc"),
+		remote:    newCounterVec("mapreduce_master_operations_remote_total", "Attempts of map operations started on a worker without their input chunk.", "proc"),
+		phases:    newHistogramVec("mapreduce_master_phase_duration_seconds", "Time taken by the phases of jobs that completed.", "proc", PHASE_SECONDS_BUCKETS),
+	}
+}
+
+// metricsList returns the metrics of master, the registered workers gauge included.
+func (master *Master) metricsList() []metric {
+	workers := &gaugeFunc{
+		name: "mapreduce_master_registered_workers",
+		help: "Workers registered with the master that haven't failed.",
+		value: func() float64 {
+			master.workersMutex.Lock()
+			defer master.workersMutex.Unlock()
+			return float64(len(master.workers))
+		},
+	}
+
+	m := master.metrics
+	return []metric{m.started, m.succeeded, m.failed, m.retried, m.local, m.remote, workers, m.phases}
+}
+
+// workerMetrics are the metrics of the operations run by a worker.
+type workerMetrics struct {
+	latency   *histogramVec
+	bytesRead *counterVec
+	emitted   *counterVec
+}
+
+func newWorkerMetrics() *workerMetrics {
+	return &workerMetrics{
+		latency:   newHistogramVec("mapreduce_worker_operation_duration_seconds", "Time taken by the operations that completed.", "proc", OPERATION_SECONDS_BUCKETS),
+		bytesRead: newCounterVec("mapreduce_worker_read_bytes_total", "Input read by operations: chunks by map, fetched partitions by reduce.", "proc"),
+		emitted:   newCounterVec("mapreduce_worker_emitted_pairs_total", "Key/value pairs emitted by the map and reduce functions.", "proc"),
+	}
+}
+
+func (metrics *workerMetrics) list() []metric {
+	return []metric{metrics.latency, metrics.bytesRead, metrics.emitted}
+}
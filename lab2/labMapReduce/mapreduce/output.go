@@ -0,0 +1,160 @@
+package mapreduce
+
+import (
+	"bufio"
+	"encoding/csv"
+	"encoding/json"
+	"io"
+	"os"
+	"strings"
+)
+
+// An OutputFormat writes the final output of a job, the result file merged by the
+// master. Intermediate files, the output of map and reduce operations, are written with
+// the Encoding of the job instead, see encoding.go.
+//
+// Formats shipped with the package:
+//
+//	JSONLinesOutputFormat   {"Key":"...","Value":"..."} per line, the default
+//	TSVOutputFormat         key and value separated by a tab, one pair per line
+//	CSVOutputFormat         key and value as a CSV row
+
+type OutputFormat interface {
+	// NewWriter returns a writer of pairs to w.
+	NewWriter(w io.Writer) RecordWriter
+}
+
+type RecordWriter interface {
+	Write(kv KeyValue) error
+
+	// Flush writes the pairs still buffered to the underlying io.Writer.
+	Flush() error
+}
+
+// Returns the format of the final output of task
+func outputFormat(task *Task) OutputFormat {
+	if task.OutputFormat == nil {
+		return JSONLinesOutputFormat{}
+	}
+	return task.OutputFormat
+}
+
+// JSONLinesOutputFormat writes every pair as a JSON document on its own line.
+type JSONLinesOutputFormat struct{}
+
+func (JSONLinesOutputFormat) NewWriter(w io.Writer) RecordWriter {
+	buffer := bufio.NewWriter(w)
+	return &jsonLinesWriter{buffer: buffer, encoder: json.NewEncoder(buffer)}
+}
+
+type jsonLinesWriter struct {
+	buffer  *bufio.Writer
+	encoder *json.Encoder
+}
+
+func (writer *jsonLinesWriter) Write(kv KeyValue) error {
+	return writer.encoder.Encode(&kv)
+}
+
+func (writer *jsonLinesWriter) Flush() error {
+	return writer.buffer.Flush()
+}
+
+// TSVOutputFormat writes every pair as its key and value separated by a tab. Tabs,
+// line breaks and backslashes in them are escaped as \t, \n, \r and \\.
+type TSVOutputFormat struct{}
+
+var tsvEscaper = strings.NewReplacer(`\`, `\\`, "\t", `\t`, "\n", `\n`, "\r", `\r`)
+
+func (TSVOutputFormat) NewWriter(w io.Writer) RecordWriter {
+	return &tsvWriter{buffer: bufio.NewWriter(w)}
+}
+
+type tsvWriter struct {
+	buffer *bufio.Writer
+}
+
+func (writer *tsvWriter) Write(kv KeyValue) error {
+	_, err := writer.buffer.WriteString(tsvEscaper.Replace(kv.Key) + "\t" + tsvEscaper.Replace(kv.Value) + "\n")
+	return err
+}
+
+func (writer *tsvWriter) Flush() error {
+	return writer.buffer.Flush()
+}
+
+// CSVOutputFormat writes every pair as a CSV row of two fields, key and value.
+type CSVOutputFormat struct {
+	Comma rune // field separator, ',' when 0
+}
+
+func (format CSVOutputFormat) NewWriter(w io.Writer) RecordWriter {
+	writer := csv.NewWriter(w)
+	if format.Comma != 0 {
+		writer.Comma = format.Comma
+	}
+	return &csvWriter{writer}
+}
+
+type csvWriter struct {
+	writer *csv.Writer
+}
+
+func (writer *csvWriter) Write(kv KeyValue) error {
+	return writer.writer.Write([]string{kv.Key, kv.Value})
+}
+
+func (writer *csvWriter) Flush() error {
+	writer.writer.Flush()
+	return writer.writer.Error()
+}
+
+// writeFile writes fileName with format, calling write with its writer. The file is
+// only visible once write returned and every pair is on disk.
+func writeFile(fileName string, op string, format OutputFormat, write func(RecordWriter) error) (err error) {
+	var (
+		file     *os.File
+		writer   RecordWriter
+		tempName string
+	)
+
+	tempName = attemptFileName(fileName, 0)
+	if file, err = os.Create(tempName); err != nil {
+		return dataError(op, fileName, err)
+	}
+
+	defer func() {
+		if err != nil {
+			file.Close()
+			os.Remove(tempName)
+		}
+	}()
+
+	buffer := bufio.NewWriter(file)
+	writer = format.NewWriter(buffer)
+	if err = write(writer); err != nil {
+		return dataError(op, fileName, err)
+	}
+
+	if err = writer.Flush(); err != nil {
+		return dataError(op, fileName, err)
+	}
+	if err = buffer.Flush(); err != nil {
+		return dataError(op, fileName, err)
+	}
+
+	if intermediate, ok := format.(intermediateFormat); ok {
+		written, compressed := writer.(pairWriter).sizes()
+		logCompression(fileName, intermediate.compression, written, compressed)
+	}
+
+	if err = file.Sync(); err != nil {
+		return dataError(op, fileName, err)
+	}
+	file.Close()
+
+	if err = os.Rename(tempName, fileName); err != nil {
+		return dataError(op, fileName, err)
+	}
+	return nil
+}
@@ -0,0 +1,126 @@
+package mapreduce
+
+import (
+	"log"
+	"os"
+	"sort"
+)
+
+// Tasks choose how keys are partitioned between reduce operations with Partitioning.
+// PARTITION_HASH partitions them with task.Shuffle. PARTITION_RANGE partitions them
+// with rangeShuffle and task.Shuffle is ignored, so the split points it needs are
+// always sampled.
+//
+// rangeShuffle sends every key to the reduce partition of its range, so each partition
+// holds the keys between two split points and concatenating the results in partition
+// order sorts them by key, like TeraSort does.
+//
+// The split points are sampled from the input of every job before its map operations
+// run: workers map RANGE_SAMPLE_SPLITS splits spread over the input, the ones holding
+// a split on their disk first, and the master takes the NumReduceJobs-1 quantiles of
+// the keys emitted, so partitions get about the same number of pairs. Operations get
+// the split points of their job with their arguments.
+
+type Partitioning string
+
+const (
+	PARTITION_HASH  Partitioning = ""
+	PARTITION_RANGE Partitioning = "range"
+)
+
+const (
+	RANGE_SAMPLE_SPLITS = 10
+	RANGE_SAMPLE_SIZE   = 100000 // keys kept from the sampled splits
+)
+
+// rangeShuffle is the ShuffleFunc of PARTITION_RANGE. It sends keys below
+// task.SplitPoints[0] to partition 0, keys from task.SplitPoints[i-1] and below
+// task.SplitPoints[i] to partition i, and the rest to the last partition.
+func rangeShuffle(task *Task, key string) int {
+	return sort.Search(len(task.SplitPoints), func(i int) bool { return task.SplitPoints[i] > key })
+}
+
+// isRangePartitioned returns true if task partitions keys with PARTITION_RANGE.
+func isRangePartitioned(task *Task) bool {
+	return task.Partitioning == PARTITION_RANGE
+}
+
+// partition returns the reduce partition of key with the partitioning of task.
+func partition(task *Task, key string) int {
+	if isRangePartitioned(task) {
+		return rangeShuffle(task, key)
+	}
+	return task.Shuffle(task, key)
+}
+
+// sampleSplitPoints returns reduceJobs-1 split points from the keys emitted by mapping
+// RANGE_SAMPLE_SPLITS of the splits input holds. sampleSplit returns the keys emitted
+// by mapping the split with the index given.
+func sampleSplitPoints(splits int, reduceJobs int, sampleSplit func(int) ([]string, error)) ([]string, error) {
+	var (
+		keys    []string
+		sampled int
+	)
+
+	if reduceJobs <= 1 || splits == 0 {
+		return nil, nil
+	}
+
+	sampled = min(splits, RANGE_SAMPLE_SPLITS)
+	for s := 0; s < sampled; s++ {
+		splitKeys, err := sampleSplit(s * splits / sampled)
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, splitKeys...)
+	}
+
+	// Every stride-th key keeps the proportions of the sample
+	if len(keys) > RANGE_SAMPLE_SIZE {
+		stride := (len(keys) + RANGE_SAMPLE_SIZE - 1) / RANGE_SAMPLE_SIZE
+		kept := keys[:0]
+		for i := 0; i < len(keys); i += stride {
+			kept = append(kept, keys[i])
+		}
+		keys = kept
+	}
+
+	if len(keys) == 0 {
+		log.Printf("Sampled no keys from %v splits, every key goes to partition 0\n", sampled)
+		return nil, nil
+	}
+
+	sort.Strings(keys)
+
+	splitPoints := make([]string, reduceJobs-1)
+	for r := range splitPoints {
+		splitPoints[r] = keys[(r+1)*len(keys)/reduceJobs]
+	}
+
+	log.Printf("Sampled %v keys from %v splits. Split points: %q\n", len(keys), sampled, splitPoints)
+	return splitPoints, nil
+}
+
+// mapKeys runs the map function of task over the input of a map operation, like
+// RunMap does, and returns the keys it emits.
+func mapKeys(task *Task, filePath string) ([]string, error) {
+	if task.InputFormat != nil {
+		result, _, err := mapSplit(task, filePath)
+		return pairKeys(result), err
+	}
+
+	buffer, err := os.ReadFile(filePath)
+	if err != nil {
+		return nil, inputError(filePath, err)
+	}
+	return pairKeys(task.mapChunk(buffer)), nil
+}
+
+// pairKeys returns the key of every pair.
+func pairKeys(pairs []KeyValue) []string {
+	keys := make([]string, len(pairs))
+	for i, kv := range pairs {
+		keys[i] = kv.Key
+	}
+	return keys
+}
@@ -0,0 +1,234 @@
+package mapreduce
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/rpc"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+const (
+	WORKER_PATH = "worker/"
+
+	// Name of the file with the result of a reduce operation, inside the directory
+	// committed by the worker that ran it.
+	WORKER_RESULT_FILE = "result"
+
+	// Files are fetched in chunks of this size, so neither side holds a whole
+	// partition in memory.
+	FETCH_CHUNK_SIZE = 1024 * 1024
+
+	FETCH_DIAL_TIMEOUT = 3 * time.Second
+	FETCH_TIMEOUT      = 10 * time.Second
+)
+
+// Returns the directory where the worker listening on hostname keeps the files of a
+// run of a job. Map outputs stay there until reducers fetch them, and reduce results
+// until the master does. Workers on separate hosts don't share it, the hostname only
+// keeps workers of the same host apart.
+func workerStorageDir(hostname string, jobId int, jobToken string) string {
+	return filepath.Join(workerStorageRoot(hostname), fmt.Sprintf("job-%v-%v", jobId, jobToken))
+}
+
+// Returns the directory with the files of every job of the worker listening on
+// hostname.
+func workerStorageRoot(hostname string) string {
+	return filepath.Join(WORKER_PATH, strings.ReplaceAll(hostname, ":", "-"))
+}
+
+// readChunk reads the chunk of fileName that starts at offset into reply.
+func readChunk(fileName string, offset int64, reply *FetchReply) error {
+	var (
+		err  error
+		file *os.File
+		n    int
+	)
+
+	if file, err = os.Open(fileName); err != nil {
+		return err
+	}
+	defer file.Close()
+
+	reply.Data = make([]byte, FETCH_CHUNK_SIZE)
+	n, err = file.ReadAt(reply.Data, offset)
+	reply.Data = reply.Data[:n]
+	reply.Done = err == io.EOF
+
+	if err != nil && err != io.EOF {
+		return err
+	}
+	return nil
+}
+
+// fetchFile calls proc through call until the whole file described by args has been
+// written to fileName.
+func fetchFile(call func(proc string, args interface{}, reply interface{}) error, proc string, args FetchArgs, fileName string) error {
+	var (
+		err   error
+		file  *os.File
+		reply *FetchReply
+	)
+
+	if file, err = os.Create(fileName); err != nil {
+		return err
+	}
+	defer file.Close()
+
+	for {
+		reply = new(FetchReply)
+		if err = call(proc, &args, reply); err != nil {
+			return err
+		}
+
+		if _, err = file.Write(reply.Data); err != nil {
+			return err
+		}
+
+		if reply.Done {
+			break
+		}
+		args.Offset += int64(len(reply.Data))
+	}
+
+	return file.Sync()
+}
+
+// fetchClient is a connection to a worker that serves map outputs. Calls that take
+// longer than FETCH_TIMEOUT fail.
+type fetchClient struct {
+	hostname string
+	client   *rpc.Client
+}
+
+func dialFetchClient(hostname string) (*fetchClient, error) {
+	conn, err := net.DialTimeout("tcp", hostname, FETCH_DIAL_TIMEOUT)
+	if err != nil {
+		return nil, err
+	}
+	return &fetchClient{hostname: hostname, client: rpc.NewClient(conn)}, nil
+}
+
+func (fc *fetchClient) call(proc string, args interface{}, reply interface{}) error {
+	call := fc.client.Go(proc, args, reply, make(chan *rpc.Call, 1))
+
+	select {
+	case <-call.Done:
+		return call.Error
+	case <-time.After(FETCH_TIMEOUT):
+		return errors.New("timed out fetching from " + fc.hostname)
+	}
+}
+
+// fetchPartition pulls the output of every map operation for the reduce partition in
+// args from the worker that holds it, listed in args.MapWorkers, and merges them into
+// fileName. Returns the ids of the map operations whose output couldn't be fetched, or
+// was corrupt: the worker holding a corrupt output is told to discard it, so it's
+// written again when the map operation runs again.
+// Every worker is dialed once, its outputs are all fetched on the same connection.
+// Stops with the error of ctx if it's done first.
+func fetchPartition(ctx context.Context, args *RunArgs, fileName string) (lostMaps []int, err error) {
+	var (
+		mergeFile   *os.File
+		fetchedName string
+		clients     map[string]*fetchClient
+		failedHosts map[string]bool
+	)
+
+	if mergeFile, err = os.Create(fileName); err != nil {
+		return nil, err
+	}
+	defer mergeFile.Close()
+
+	fetchedName = fileName + ".fetch"
+	defer os.Remove(fetchedName)
+
+	clients = make(map[string]*fetchClient)
+	defer func() {
+		for _, fc := range clients {
+			fc.client.Close()
+		}
+	}()
+
+	// Once a worker fails, the rest of its map outputs aren't even tried.
+	failedHosts = make(map[string]bool)
+
+	for m, hostname := range args.MapWorkers {
+		if err = ctx.Err(); err != nil {
+			return nil, err
+		}
+
+		if failedHosts[hostname] {
+			lostMaps = append(lostMaps, m)
+			continue
+		}
+
+		fc := clients[hostname]
+		if fc == nil {
+			if fc, err = dialFetchClient(hostname); err != nil {
+				log.Printf("Failed to connect to '%v'. Error: %v\n", hostname, err)
+				failedHosts[hostname] = true
+				lostMaps = append(lostMaps, m)
+				continue
+			}
+			clients[hostname] = fc
+		}
+
+		fetchArgs := FetchArgs{JobId: args.JobId, JobToken: args.JobToken, MapId: m, ReduceId: args.Id}
+		if err = fetchFile(fc.call, "Worker.FetchMapOutput", fetchArgs, fetchedName); err != nil {
+			log.Printf("Failed to fetch output of map %v from '%v'. Error: %v\n", m, hostname, err)
+			// A worker that answers with an error only lost this output
+			if _, answered := err.(rpc.ServerError); !answered {
+				failedHosts[hostname] = true
+			}
+			lostMaps = append(lostMaps, m)
+			continue
+		}
+
+		// Every pair is decoded before it's merged, a corrupt output would fail every
+		// attempt of the reduce operation
+		if err = decodeEach(fetchedName, func(KeyValue) error { return nil }); errors.Is(err, ErrCorrupt) {
+			log.Printf("Output of map %v from '%v' is corrupt. Error: %v\n", m, hostname, err)
+			if err = fc.call("Worker.DiscardMapOutput", &fetchArgs, new(struct{})); err != nil {
+				log.Printf("Failed to discard output of map %v on '%v'. Error: %v\n", m, hostname, err)
+			}
+			lostMaps = append(lostMaps, m)
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+
+		if err = appendFile(mergeFile, fetchedName); err != nil {
+			return nil, err
+		}
+	}
+
+	if err = mergeFile.Sync(); err != nil {
+		return nil, err
+	}
+	return lostMaps, nil
+}
+
+// appendFile copies the content of fileName to the end of dst.
+func appendFile(dst *os.File, fileName string) error {
+	var (
+		err  error
+		file *os.File
+	)
+
+	if file, err = os.Open(fileName); err != nil {
+		return err
+	}
+	defer file.Close()
+
+	if _, err = io.Copy(dst, file); err != nil {
+		return fmt.Errorf("copying %v: %v", fileName, err)
+	}
+	return nil
+}
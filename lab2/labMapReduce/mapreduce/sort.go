@@ -0,0 +1,314 @@
+package mapreduce
+
+import (
+	"container/heap"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+)
+
+const (
+	// Default amount of reduce input (in bytes) kept in memory while sorting a reduce
+	// partition. When a partition is bigger than the limit, sorted runs are spilled to
+	// the directory of the partition and merged afterwards. See Task.ReduceMemoryLimit.
+	REDUCE_MEMORY_LIMIT = 64 * 1024 * 1024
+
+	// Estimated memory used by a KeyValue besides the bytes of its strings.
+	KEY_VALUE_OVERHEAD = 32
+)
+
+// Returns the estimated memory held by a pair while it is buffered
+func keyValueSize(kv KeyValue) int {
+	return len(kv.Key) + len(kv.Value) + KEY_VALUE_OVERHEAD
+}
+
+// Returns the memory ceiling of reduce operations for task
+func reduceMemoryLimit(task *Task) int {
+	if task.ReduceMemoryLimit > 0 {
+		return task.ReduceMemoryLimit
+	}
+	return REDUCE_MEMORY_LIMIT
+}
+
+// Returns the pattern of the files used to spill sorted runs of a reduce partition.
+// The random suffix keeps concurrent attempts of the same reduce apart.
+func sortRunPattern(idReduce int, idRun int) string {
+	return fmt.Sprintf("sort-%v-%v-*", idReduce, idRun)
+}
+
+// sortByKey sorts data by key, pairs with the same key keep their order.
+func sortByKey(data []KeyValue) {
+	sort.SliceStable(data, func(i, j int) bool { return data[i].Key < data[j].Key })
+}
+
+// ValueIterator walks over the values of a single key in a sorted reduce partition.
+// It's only valid during the ReduceByKey call that received it.
+type ValueIterator struct {
+	key    string
+	stream *sortedStream
+}
+
+// Next returns the next value for the current key. ok is false when there are no
+// more values for this key.
+func (it *ValueIterator) Next() (value string, ok bool) {
+	var kv KeyValue
+
+	if kv, ok = it.stream.peek(); !ok || kv.Key != it.key {
+		return "", false
+	}
+
+	it.stream.next()
+	return kv.Value, true
+}
+
+// sortedRun is one sorted source of pairs: either a slice still in memory or a
+// spilled run that is being read back from disk.
+type sortedRun struct {
+	index   int
+	current KeyValue
+	data    []KeyValue
+	file    *os.File
+	decoder pairReader
+	err     error
+}
+
+// advance loads the next pair of the run into current. Returns false when the
+// run is exhausted or can't be read, err tells which.
+func (run *sortedRun) advance() bool {
+	if run.decoder == nil {
+		if len(run.data) == 0 {
+			return false
+		}
+		run.current = run.data[0]
+		run.data = run.data[1:]
+		return true
+	}
+
+	var kv KeyValue
+	if err := run.decoder.Decode(&kv); err != nil {
+		if err != io.EOF {
+			run.err = corruptError(run.file.Name(), err)
+		}
+		return false
+	}
+	run.current = kv
+	return true
+}
+
+// runHeap orders runs by their current key. Ties are broken by run index so values
+// of the same key come out in the order they were read from the partition.
+type runHeap []*sortedRun
+
+func (h runHeap) Len() int { return len(h) }
+func (h runHeap) Less(i, j int) bool {
+	if h[i].current.Key != h[j].current.Key {
+		return h[i].current.Key < h[j].current.Key
+	}
+	return h[i].index < h[j].index
+}
+func (h runHeap) Swap(i, j int)       { h[i], h[j] = h[j], h[i] }
+func (h *runHeap) Push(x interface{}) { *h = append(*h, x.(*sortedRun)) }
+func (h *runHeap) Pop() interface{} {
+	old := *h
+	run := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return run
+}
+
+// sortedStream is the k-way merge of all the sorted runs of a partition.
+type sortedStream struct {
+	runs     runHeap
+	spillDir string
+	encoding Encoding // of the spilled runs
+	spills   []string
+	err      error // first error reading a spilled run, the stream ends there
+
+	// One pair of lookahead, so reducers can tell where a key ends.
+	peeked    bool
+	lookahead KeyValue
+	ok        bool
+}
+
+// peek returns the next pair of the stream without consuming it.
+func (stream *sortedStream) peek() (KeyValue, bool) {
+	if !stream.peeked {
+		stream.lookahead, stream.ok = stream.pop()
+		stream.peeked = true
+	}
+	return stream.lookahead, stream.ok
+}
+
+// next consumes and returns the next pair of the stream.
+func (stream *sortedStream) next() (KeyValue, bool) {
+	kv, ok := stream.peek()
+	stream.peeked = false
+	return kv, ok
+}
+
+func (stream *sortedStream) pop() (KeyValue, bool) {
+	if stream.runs.Len() == 0 {
+		return KeyValue{}, false
+	}
+
+	run := stream.runs[0]
+	kv := run.current
+
+	if run.advance() {
+		heap.Fix(&stream.runs, 0)
+	} else if run.err != nil {
+		// The stream ends here, so none of its runs is read anymore
+		stream.err = run.err
+		stream.closeRuns()
+	} else {
+		heap.Pop(&stream.runs)
+		if run.file != nil {
+			run.file.Close()
+		}
+	}
+	return kv, true
+}
+
+// closeRuns closes the files of the runs still open and drops them from the stream.
+func (stream *sortedStream) closeRuns() {
+	for _, run := range stream.runs {
+		if run.file != nil {
+			run.file.Close()
+		}
+	}
+	stream.runs = nil
+}
+
+// close releases the spilled runs of the stream.
+func (stream *sortedStream) close() {
+	stream.closeRuns()
+	for _, spill := range stream.spills {
+		_ = os.Remove(spill)
+	}
+}
+
+// sortPartition reads every pair from decoder, which reads the partition in source, and
+// returns them sorted by key. At most memoryLimit bytes of pairs are kept in memory,
+// the rest is spilled to spillDir as sorted runs, with encoding.
+func sortPartition(source string, spillDir string, idReduce int, decoder pairReader, encoding Encoding, memoryLimit int) (*sortedStream, error) {
+	var (
+		err        error
+		buffer     []KeyValue
+		bufferSize int
+		stream     *sortedStream
+	)
+
+	stream = &sortedStream{spillDir: spillDir, encoding: encoding}
+	buffer = make([]KeyValue, 0)
+
+	for {
+		var kv KeyValue
+		if err = decoder.Decode(&kv); err == io.EOF {
+			break
+		}
+		if err != nil {
+			stream.close()
+			return nil, corruptError(source, err)
+		}
+
+		buffer = append(buffer, kv)
+		bufferSize += keyValueSize(kv)
+
+		if bufferSize >= memoryLimit {
+			if err = stream.spill(idReduce, buffer); err != nil {
+				stream.close()
+				return nil, err
+			}
+			buffer = buffer[:0]
+			bufferSize = 0
+		}
+	}
+
+	// Spilled runs hold older pairs than the buffer still in memory, so they come
+	// first in the merge order.
+	for i, spill := range stream.spills {
+		run := &sortedRun{index: i}
+		if run.file, err = os.Open(spill); err != nil {
+			stream.close()
+			return nil, dataError("open sorted run", spill, err)
+		}
+		run.decoder = newPairReader(run.file)
+		if err = stream.addRun(run); err != nil {
+			stream.close()
+			return nil, err
+		}
+	}
+
+	sortByKey(buffer)
+	stream.addRun(&sortedRun{index: len(stream.spills), data: buffer})
+
+	heap.Init(&stream.runs)
+
+	return stream, nil
+}
+
+// addRun loads the first pair of run and adds it to the merge if it isn't empty.
+func (stream *sortedStream) addRun(run *sortedRun) error {
+	if run.advance() {
+		stream.runs = append(stream.runs, run)
+	} else if run.file != nil {
+		run.file.Close()
+	}
+	return run.err
+}
+
+// spill sorts buffer and writes it to a new run file.
+func (stream *sortedStream) spill(idReduce int, buffer []KeyValue) error {
+	var (
+		err      error
+		file     *os.File
+		pairs    pairWriter
+		fileName string
+	)
+
+	sortByKey(buffer)
+
+	if file, err = os.CreateTemp(stream.spillDir, sortRunPattern(idReduce, len(stream.spills))); err != nil {
+		return dataError("spill sorted run", stream.spillDir, err)
+	}
+	fileName = file.Name()
+	stream.spills = append(stream.spills, fileName)
+
+	if pairs, err = newPairWriter(file, stream.encoding, COMPRESSION_NONE); err != nil {
+		file.Close()
+		return dataError("spill sorted run", fileName, err)
+	}
+	for _, kv := range buffer {
+		if err = pairs.Write(kv); err != nil {
+			break
+		}
+	}
+	if err == nil {
+		err = pairs.Flush()
+	}
+	if err != nil {
+		file.Close()
+		return dataError("spill sorted run", fileName, err)
+	}
+	return dataError("spill sorted run", fileName, file.Close())
+}
+
+// reduceSorted calls the per-key reduce function of task once for every key in the
+// stream, in key order, and hands every resulting pair to emit as soon as it's produced.
+func reduceSorted(task *Task, stream *sortedStream, emit func(KeyValue)) {
+	for {
+		kv, ok := stream.peek()
+		if !ok {
+			break
+		}
+
+		it := &ValueIterator{kv.Key, stream}
+		for _, result := range task.reduceByKey(kv.Key, it) {
+			emit(result)
+		}
+
+		// Skip whatever the reducer didn't consume.
+		for _, ok = it.Next(); ok; _, ok = it.Next() {
+		}
+	}
+}
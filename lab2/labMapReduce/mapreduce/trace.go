@@ -0,0 +1,185 @@
+package mapreduce
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Traces are written in the Chrome trace event format, which chrome://tracing and
+// https://ui.perfetto.dev load:
+// https://docs.google.com/document/d/1CvAClvFfyA5R-PhYUmn5OOQtYMH4h6I0nSsKchNAySU
+//
+// Phases of the job are drawn on the master track and every attempt of an operation
+// on the track of the worker slot that ran it. An arrow links a failed attempt to the next
+// attempt of the same operation.
+const (
+	TRACE_MASTER_PID = 0
+	TRACE_WORKER_PID = 1
+
+	// Tracks of the slots of a worker are numbered from its id times this
+	TRACE_SLOTS_PER_WORKER = 1000
+)
+
+// Outcomes of an attempt shown in the trace
+const (
+	ATTEMPT_SUCCEEDED     = "succeeded"
+	ATTEMPT_DISCARDED     = "discarded" // another attempt of the operation finished first
+	ATTEMPT_BLOCKED       = "blocked"
+	ATTEMPT_FAILED        = "failed"
+	ATTEMPT_WORKER_FAILED = "worker failed"
+	ATTEMPT_CANCELLED     = "cancelled" // timed out or the job was stopped
+)
+
+type traceEvent struct {
+	Name string                 `json:"name"`
+	Cat  string                 `json:"cat,omitempty"`
+	Ph   string                 `json:"ph"`
+	Ts   int64                  `json:"ts"` // microseconds since the job started
+	Dur  int64                  `json:"dur,omitempty"`
+	Pid  int                    `json:"pid"`
+	Tid  int                    `json:"tid"`
+	Id   int                    `json:"id,omitempty"`
+	Bp   string                 `json:"bp,omitempty"`
+	Args map[string]interface{} `json:"args,omitempty"`
+}
+
+// jobTrace records the timeline of a job. A nil *jobTrace records nothing, so callers
+// don't need to check if tracing is enabled.
+type jobTrace struct {
+	mutex  sync.Mutex
+	start  time.Time
+	events []traceEvent
+	tracks map[int]string // names of the worker slot tracks, by tid
+
+	// Flow started by the last failed attempt of an operation, finished by its next one
+	retries  map[string]int
+	lastFlow int
+}
+
+func newJobTrace() *jobTrace {
+	return &jobTrace{
+		start:   time.Now(),
+		events:  make([]traceEvent, 0),
+		tracks:  make(map[int]string),
+		retries: make(map[string]int),
+	}
+}
+
+// Returns the name of the file a job writes its trace to. Jobs other than the single
+// job of RunMaster get the job id appended, so their traces don't overwrite each other.
+func traceFileName(fileName string, jobId int) string {
+	if jobId == 0 {
+		return fileName
+	}
+
+	ext := filepath.Ext(fileName)
+	return fmt.Sprintf("%v-job-%v%v", strings.TrimSuffix(fileName, ext), jobId, ext)
+}
+
+func (trace *jobTrace) since(t time.Time) int64 {
+	return t.Sub(trace.start).Microseconds()
+}
+
+// attempt records an attempt of operation on a slot of remoteWorker that ran from start
+// to end.
+func (trace *jobTrace) attempt(operation *Operation, attempt int, remoteWorker *RemoteWorker, slot int, backup bool, start time.Time, end time.Time, outcome string) {
+	if trace == nil {
+		return
+	}
+
+	trace.mutex.Lock()
+	defer trace.mutex.Unlock()
+
+	key := fmt.Sprintf("%v-%v", operation.proc, operation.id)
+	tid := remoteWorker.id*TRACE_SLOTS_PER_WORKER + slot
+	trace.tracks[tid] = fmt.Sprintf("worker %v slot %v (%v)", remoteWorker.id, slot, remoteWorker.hostname)
+
+	trace.events = append(trace.events, traceEvent{
+		Name: fmt.Sprintf("%v %v", phaseName(operation.proc), operation.id),
+		Cat:  operation.proc,
+		Ph:   "X",
+		Ts:   trace.since(start),
+		Dur:  end.Sub(start).Microseconds(),
+		Pid:  TRACE_WORKER_PID,
+		Tid:  tid,
+		Args: map[string]interface{}{
+			"operation": operation.id,
+			"attempt":   attempt,
+			"backup":    backup,
+			"outcome":   outcome,
+			"worker":    remoteWorker.hostname,
+			"slot":      slot,
+			"file":      operation.filePath,
+		},
+	})
+
+	// Link the attempt to the failure that caused it
+	if flow, ok := trace.retries[key]; ok {
+		delete(trace.retries, key)
+		trace.events = append(trace.events, traceEvent{Name: "retry", Cat: operation.proc, Ph: "f", Bp: "e", Ts: trace.since(start), Pid: TRACE_WORKER_PID, Tid: tid, Id: flow})
+	}
+
+	switch outcome {
+	case ATTEMPT_FAILED, ATTEMPT_WORKER_FAILED, ATTEMPT_CANCELLED:
+		trace.lastFlow++
+		trace.retries[key] = trace.lastFlow
+		trace.events = append(trace.events, traceEvent{Name: "retry", Cat: operation.proc, Ph: "s", Ts: trace.since(end), Pid: TRACE_WORKER_PID, Tid: tid, Id: trace.lastFlow})
+	}
+}
+
+// phase records a phase of the job that ran from start to end.
+func (trace *jobTrace) phase(proc string, start time.Time, end time.Time, summary string) {
+	if trace == nil {
+		return
+	}
+
+	trace.mutex.Lock()
+	defer trace.mutex.Unlock()
+
+	trace.events = append(trace.events, traceEvent{
+		Name: phaseName(proc),
+		Cat:  "phase",
+		Ph:   "X",
+		Ts:   trace.since(start),
+		Dur:  end.Sub(start).Microseconds(),
+		Pid:  TRACE_MASTER_PID,
+		Args: map[string]interface{}{"summary": summary},
+	})
+}
+
+// write saves the trace to fileName.
+func (trace *jobTrace) write(fileName string) error {
+	var (
+		err    error
+		file   *os.File
+		events []traceEvent
+	)
+
+	trace.mutex.Lock()
+	defer trace.mutex.Unlock()
+
+	// Name the tracks after the master and the workers
+	events = []traceEvent{
+		{Name: "process_name", Ph: "M", Pid: TRACE_MASTER_PID, Args: map[string]interface{}{"name": "master"}},
+		{Name: "process_name", Ph: "M", Pid: TRACE_WORKER_PID, Args: map[string]interface{}{"name": "workers"}},
+	}
+	for tid, name := range trace.tracks {
+		events = append(events, traceEvent{Name: "thread_name", Ph: "M", Pid: TRACE_WORKER_PID, Tid: tid, Args: map[string]interface{}{"name": name}})
+	}
+	events = append(events, trace.events...)
+
+	if file, err = os.Create(fileName); err != nil {
+		return err
+	}
+	defer file.Close()
+
+	if err = json.NewEncoder(file).Encode(map[string]interface{}{"traceEvents": events, "displayTimeUnit": "ms"}); err != nil {
+		return err
+	}
+	return file.Sync()
+}
@@ -1,9 +1,15 @@
 package mapreduce
 
 import (
+	"context"
+	"fmt"
 	"log"
 	"net"
 	"net/rpc"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
 )
 
 type Worker struct {
@@ -19,9 +25,23 @@ type Worker struct {
 	task *Task
 	done chan bool
 
-	// Induced failures
-	taskCounter int
-	nOps        int
+	// Operations run at the same time, each in its own RPC call
+	slots int
+
+	// Induced failures, nil unless the worker was given a FaultSpec. Shared by the
+	// concurrent operations, it has its own lock.
+	faults *faultInjector
+
+	// Last heartbeat received from master
+	pingMutex sync.Mutex
+	lastPing  time.Time
+
+	// Running operations, so master can cancel them
+	operationsMutex sync.Mutex
+	operations      map[string]context.CancelFunc
+
+	// Served on /metrics when task.MetricsAddress is set
+	metrics *workerMetrics
 }
 
 // Call RPC Register on Master to notify that this worker is ready to receive operations.
@@ -36,6 +56,8 @@ func (worker *Worker) register() error {
 
 	args = new(RegisterArgs)
 	args.WorkerHostname = worker.hostname
+	args.Slots = worker.slots
+	args.Chunks = worker.localChunks()
 
 	reply = new(RegisterReply)
 
@@ -50,6 +72,80 @@ func (worker *Worker) register() error {
 	return err
 }
 
+// localChunks returns the input chunks on the disk of the worker, the files matched by
+// task.LocalChunks.
+func (worker *Worker) localChunks() []string {
+	if worker.task.LocalChunks == "" {
+		return nil
+	}
+
+	chunks, err := filepath.Glob(worker.task.LocalChunks)
+	if err != nil {
+		log.Println("Failed to list local chunks. Error:", err)
+	}
+	return chunks
+}
+
+// registerWithRetry calls register until it succeeds.
+func (worker *Worker) registerWithRetry() {
+	var (
+		err           error
+		retryDuration time.Duration
+	)
+
+	retryDuration = time.Duration(2) * time.Second
+	for {
+		err = worker.register()
+
+		if err == nil {
+			break
+		}
+
+		log.Printf("Registration failed. Retrying in %v seconds...\n", retryDuration)
+		time.Sleep(retryDuration)
+	}
+
+	worker.pinged()
+}
+
+// watchMaster registers this worker again when the master stops sending heartbeats,
+// which happens when it's restarted to resume a job.
+func (worker *Worker) watchMaster() {
+	var (
+		timeout time.Duration
+		ticker  *time.Ticker
+	)
+
+	_, timeout = heartbeatSettings(worker.task)
+
+	ticker = time.NewTicker(timeout)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-worker.done:
+			return
+		case <-ticker.C:
+		}
+
+		worker.pingMutex.Lock()
+		lost := time.Since(worker.lastPing) > timeout
+		worker.pingMutex.Unlock()
+
+		if lost {
+			log.Printf("No heartbeats from Master for %v.\n", timeout)
+			worker.registerWithRetry()
+		}
+	}
+}
+
+// pinged records that master has just been heard from.
+func (worker *Worker) pinged() {
+	worker.pingMutex.Lock()
+	worker.lastPing = time.Now()
+	worker.pingMutex.Unlock()
+}
+
 // acceptMultipleConnections will handle the connections from multiple workers.
 func (worker *Worker) acceptMultipleConnections() error {
 	var (
@@ -63,7 +159,9 @@ func (worker *Worker) acceptMultipleConnections() error {
 		newConn, err = worker.listener.Accept()
 
 		if err == nil {
-			go worker.handleConnection(&newConn)
+			// Each goroutine needs its own copy, newConn is reused by the next Accept.
+			conn := newConn
+			go worker.handleConnection(&conn)
 		} else {
 			log.Println("Failed to accept connection. Error: ", err)
 			break
@@ -76,6 +174,12 @@ func (worker *Worker) acceptMultipleConnections() error {
 
 // Handle a single connection until it's done, then closes it.
 func (worker *Worker) handleConnection(conn *net.Conn) error {
+	if worker.faults != nil {
+		// Faults are decided as requests are read, some replies are dropped
+		worker.rpcServer.ServeCodec(newFaultCodec(*conn, worker.faults))
+		return nil
+	}
+
 	worker.rpcServer.ServeConn(*conn)
 	(*conn).Close()
 	return nil
@@ -103,13 +207,89 @@ func (worker *Worker) callMaster(proc string, args interface{}, reply interface{
 	return nil
 }
 
-// shouldFail will keep track of executed operations and return true when nOps operations
-// have been executed (before or during operation)
-func (worker *Worker) shouldFail(during bool) bool {
-	if worker.nOps == 0 {
-		return false
+// jobTask returns the task of the job an operation belongs to. Jobs share the functions
+// of the worker task but each one has its own number of reduce jobs, encoding,
+// partitioning and split points. Every operation gets its own counters.
+func (worker *Worker) jobTask(args *RunArgs) *Task {
+	task := *worker.task
+	task.NumReduceJobs = args.ReduceJobs
+	task.Encoding = args.Encoding
+	task.Partitioning = args.Partitioning
+	task.SplitPoints = args.SplitPoints
+	task.counters = newCounters()
+	return &task
+}
+
+// checkInputFormat returns a fatal error if task reads the input of a map operation with
+// another format than the one it was split with. Every worker started like this one
+// would fail the same way.
+func checkInputFormat(task *Task, args *RunArgs) error {
+	if name := inputFormatName(task.InputFormat); name != args.InputFormat {
+		err := fmt.Errorf("input of job %v was split with input format '%v', this worker reads '%v'", args.JobId, args.InputFormat, name)
+		return &DataError{Op: "read input", Path: args.FilePath, Err: err, Fatal: true}
+	}
+	return nil
+}
+
+// createStorageDir creates the directories where this worker keeps the files of the
+// job an operation belongs to and returns the job's one.
+func (worker *Worker) createStorageDir(args *RunArgs) string {
+	dir := workerStorageDir(worker.hostname, args.JobId, args.JobToken)
+	_ = os.MkdirAll(filepath.Join(dir, REDUCE_PATH), os.ModePerm)
+	_ = os.MkdirAll(filepath.Join(dir, RESULT_PATH), os.ModePerm)
+	return dir
+}
+
+// Returns the key of an attempt of an operation in Worker.operations.
+func operationKey(jobId int, proc string, id int, attempt int) string {
+	return fmt.Sprintf("%v/%v/%v/%v", jobId, proc, id, attempt)
+}
+
+// startOperation records an attempt of an operation as running. The returned context
+// is cancelled when master calls Cancel for it. The returned function must be called
+// when the attempt is over.
+func (worker *Worker) startOperation(proc string, args *RunArgs) (context.Context, func()) {
+	key := operationKey(args.JobId, proc, args.Id, args.Attempt)
+	ctx, cancel := context.WithCancel(context.Background())
+
+	worker.operationsMutex.Lock()
+	worker.operations[key] = cancel
+	worker.operationsMutex.Unlock()
+
+	return ctx, func() {
+		worker.operationsMutex.Lock()
+		delete(worker.operations, key)
+		worker.operationsMutex.Unlock()
+
+		cancel()
 	}
+}
 
-	worker.taskCounter++
-	return worker.taskCounter == worker.nOps
+// cancelOperation cancels an attempt of an operation if it's still running.
+func (worker *Worker) cancelOperation(args *CancelArgs) bool {
+	worker.operationsMutex.Lock()
+	defer worker.operationsMutex.Unlock()
+
+	cancel, ok := worker.operations[operationKey(args.JobId, args.Proc, args.Id, args.Attempt)]
+	if ok {
+		cancel()
+	}
+	return ok
+}
+
+// runCancellable runs f and returns the error of ctx if it was done by the time f
+// returned, whatever f produced is then discarded by the caller. User functions can't
+// be interrupted, so f is waited for anyway: the master keeps the slot of an attempt
+// busy until this worker replies, and a hung function mustn't leave the worker running
+// more operations than it has slots.
+func runCancellable(ctx context.Context, f func()) error {
+	f()
+	return ctx.Err()
+}
+
+// abandon logs that an attempt of an operation was cancelled or failed and returns the
+// error reported to master.
+func (worker *Worker) abandon(kind string, args *RunArgs, err error) error {
+	log.Printf("Abandoning %v id: %v, attempt: %v. Error: %v\n", kind, args.Id, args.Attempt, err)
+	return err
 }
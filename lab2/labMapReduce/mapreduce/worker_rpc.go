@@ -1,79 +1,311 @@
 package mapreduce
 
 import (
-	"encoding/json"
+	"bufio"
+	"context"
+	"fmt"
 	"io/ioutil"
 	"log"
 	"os"
+	"path/filepath"
 	"time"
 )
 
 // RPC - RunMap
-// Run the map operation defined in the task and return when it's done.
-func (worker *Worker) RunMap(args *RunArgs, _ *struct{}) error {
+// Run the map operation defined in the task and return when it's done. The output is
+// kept by this worker until reducers fetch it with FetchMapOutput. Returns without
+// output if master cancels it, once the map function returns. The counts of its
+// counters are returned in reply.
+func (worker *Worker) RunMap(args *RunArgs, reply *RunReply) error {
 	var (
-		err       error
-		buffer    []byte
-		mapResult []KeyValue
+		err          error
+		buffer       []byte
+		bytesRead    int
+		mapResult    []KeyValue
+		mapErr       error
+		task         *Task
+		dir          string
+		committer    *outputCommitter
+		file         *os.File
+		ctx          context.Context
+		endOperation func()
+		start        time.Time
+		faults       []FaultRule
 	)
 
-	if worker.shouldFail(false) {
-		mapResult = make([]KeyValue, 0)
-		storeLocal(worker.task, args.Id, mapResult)
-		// Allow descriptors to be closed.
-		time.Sleep(time.Duration(100) * time.Millisecond)
-		panic("Induced failure.")
-	}
+	start = time.Now()
+	ctx, endOperation = worker.startOperation("Worker.RunMap", args)
+	defer endOperation()
+
+	task = worker.jobTask(args)
+	dir = worker.createStorageDir(args)
+	faults = worker.faults.take("Worker.RunMap", args)
 
 	log.Printf("Running map id: %v, path: %v\n", args.Id, args.FilePath)
 
-	if buffer, err = ioutil.ReadFile(args.FilePath); err != nil {
-		log.Fatal(err)
+	if err = injectFaults(ctx, faults, FAULT_BEFORE, nil); err != nil {
+		return worker.abandon("map", args, err)
+	}
+
+	if err = checkInputFormat(task, args); err != nil {
+		return worker.abandon("map", args, err)
+	}
+
+	if task.InputFormat != nil {
+		// Records are read as they're mapped, so reading is cancelled with the map
+		err = runCancellable(ctx, func() { mapResult, bytesRead, mapErr = mapSplit(task, args.FilePath) })
+		if err == nil {
+			err = mapErr
+		}
+		if err != nil {
+			return worker.abandon("map", args, err)
+		}
+	} else {
+		if buffer, err = ioutil.ReadFile(args.FilePath); err != nil {
+			return worker.abandon("map", args, inputError(args.FilePath, err))
+		}
+		bytesRead = len(buffer)
+
+		if err = runCancellable(ctx, func() { mapResult = task.mapChunk(buffer) }); err != nil {
+			return worker.abandon("map", args, err)
+		}
+	}
+
+	err = injectFaults(ctx, faults, FAULT_DURING, func() {
+		// The partial output is never committed, so no reducer ever sees it.
+		if committer, err = newOutputCommitter(filepath.Join(dir, REDUCE_PATH, mapOutputName(args.Id)), args.Attempt); err != nil {
+			log.Fatal(err)
+		}
+		if file, err = committer.create(partitionName(0)); err != nil {
+			log.Fatal(err)
+		}
+		file.Close()
+	})
+	if err != nil {
+		return worker.abandon("map", args, err)
 	}
 
-	mapResult = worker.task.Map(buffer)
-	storeLocal(worker.task, args.Id, mapResult)
+	if err = storeLocal(task, dir, args.Id, args.Attempt, mapResult); err != nil {
+		return worker.abandon("map", args, err)
+	}
+	corruptFiles(faults, filepath.Join(dir, REDUCE_PATH, mapOutputName(args.Id)))
+
+	if err = injectFaults(ctx, faults, FAULT_AFTER, nil); err != nil {
+		return worker.abandon("map", args, err)
+	}
+
+	reply.Counters = task.counters.snapshot()
+
+	worker.metrics.bytesRead.add("Worker.RunMap", float64(bytesRead))
+	worker.metrics.emitted.add("Worker.RunMap", float64(len(mapResult)))
+	worker.metrics.latency.observe("Worker.RunMap", time.Since(start).Seconds())
 	return nil
 }
 
-// RPC - RunMap
-// Run the reduce operation defined in the task and return when it's done.
-func (worker *Worker) RunReduce(args *RunArgs, _ *struct{}) error {
+// RPC - SampleMap
+// Run the map function over the input of a map operation and return the keys it emits,
+// so master samples the keys of a job from the disks of the workers. Nothing is stored
+// and the counts of the counters are dropped.
+func (worker *Worker) SampleMap(args *RunArgs, reply *SampleReply) error {
+	task := worker.jobTask(args)
+
+	log.Printf("Sampling path: %v\n", args.FilePath)
+
+	if err := checkInputFormat(task, args); err != nil {
+		return err
+	}
+
+	keys, err := mapKeys(task, args.FilePath)
+	if err != nil {
+		return err
+	}
+	reply.Keys = keys
+	return nil
+}
+
+// RPC - RunReduce
+// Run the reduce operation defined in the task and return when it's done. Its input
+// is fetched from the workers that ran the map operations and the result is kept by
+// this worker until the master fetches it with FetchResult. Returns without result if
+// master cancels it, once the reduce function returns. The counts of its counters are
+// returned in reply.
+func (worker *Worker) RunReduce(args *RunArgs, reply *RunReply) error {
 	log.Printf("Running reduce id: %v, path: %v\n", args.Id, args.FilePath)
 
 	var (
+		ctx          context.Context
+		endOperation func()
 		err          error
-		reduceResult []KeyValue
 		file         *os.File
-		fileEncoder  *json.Encoder
+		fileWriter   *bufio.Writer
+		pairs        pairWriter
+		task         *Task
+		dir          string
+		inputName    string
+		committer    *outputCommitter
+		committed    bool
+		start        time.Time
+		inputInfo    os.FileInfo
+		emitted      int
+		faults       []FaultRule
 	)
 
-	if worker.shouldFail(false) {
-		if file, err = os.Create(resultFileName(args.Id)); err != nil {
-			log.Fatal(err)
+	start = time.Now()
+	ctx, endOperation = worker.startOperation("Worker.RunReduce", args)
+	defer endOperation()
+
+	task = worker.jobTask(args)
+	dir = worker.createStorageDir(args)
+	inputName = attemptFileName(filepath.Join(dir, REDUCE_PATH, mergeReduceName(args.Id)), args.Attempt)
+	faults = worker.faults.take("Worker.RunReduce", args)
+
+	if committer, err = newOutputCommitter(resultFileName(dir, args.Id), args.Attempt); err != nil {
+		return worker.abandon("reduce", args, dataError("store result", resultFileName(dir, args.Id), err))
+	}
+
+	if err = injectFaults(ctx, faults, FAULT_BEFORE, nil); err != nil {
+		committer.abort()
+		return worker.abandon("reduce", args, err)
+	}
+
+	defer os.Remove(inputName)
+
+	if reply.LostMaps, err = fetchPartition(ctx, args, inputName); err != nil {
+		committer.abort()
+		if ctx.Err() != nil {
+			return worker.abandon("reduce", args, err)
 		}
-		file.Sync()
+		return worker.abandon("reduce", args, dataError("fetch partition", inputName, err))
+	}
+
+	if len(reply.LostMaps) > 0 {
+		log.Printf("Output of map operations %v was lost. Can't run reduce id: %v\n", reply.LostMaps, args.Id)
+		committer.abort()
+		return nil
+	}
+
+	if file, err = committer.create(WORKER_RESULT_FILE); err != nil {
+		committer.abort()
+		return worker.abandon("reduce", args, dataError("store result", resultFileName(dir, args.Id), err))
+	}
+
+	// Results are written as the reducer produces them instead of being collected first.
+	fileWriter = bufio.NewWriter(file)
+	if pairs, err = newPairWriter(fileWriter, task.Encoding, task.Compression); err != nil {
 		file.Close()
-		// Allow descriptors to be closed.
-		time.Sleep(time.Duration(100) * time.Millisecond)
-		panic("Induced failure.")
+		committer.abort()
+		return worker.abandon("reduce", args, dataError("store result", file.Name(), err))
+	}
+
+	var reduceErr error
+	err = runCancellable(ctx, func() {
+		var writeErr error
+
+		// Nothing is written once the attempt is cancelled, its result is discarded
+		reduceErr = reduceStream(task, inputName, args.Id, func(kv KeyValue) {
+			if writeErr == nil {
+				writeErr = ctx.Err()
+			}
+			if writeErr == nil {
+				writeErr = pairs.Write(kv)
+			}
+			emitted++
+		})
+
+		if writeErr == nil {
+			writeErr = pairs.Flush()
+		}
+		if writeErr == nil {
+			writeErr = fileWriter.Flush()
+		}
+		if writeErr == nil {
+			writeErr = file.Sync()
+		}
+		file.Close()
+
+		if reduceErr == nil {
+			reduceErr = dataError("store result", file.Name(), writeErr)
+		}
+	})
+
+	if err == nil {
+		err = reduceErr
+	}
+
+	if err != nil {
+		committer.abort()
+		return worker.abandon("reduce", args, err)
+	}
+	written, compressed := pairs.sizes()
+	logCompression(fmt.Sprintf("result of reduce %v", args.Id), task.Compression, written, compressed)
+
+	// The partial result is never committed, so the master never fetches it.
+	if err = injectFaults(ctx, faults, FAULT_DURING, nil); err != nil {
+		committer.abort()
+		return worker.abandon("reduce", args, err)
 	}
 
-	data := loadLocal(args.Id)
+	if committed, err = committer.commit(); err != nil {
+		committer.abort()
+		return worker.abandon("reduce", args, dataError("commit result", resultFileName(dir, args.Id), err))
+	}
 
-	reduceResult = worker.task.Reduce(data)
+	if !committed {
+		log.Printf("Discarding attempt %v of reduce %v, its result was already committed.\n", args.Attempt, args.Id)
+	} else {
+		corruptFiles(faults, resultFileName(dir, args.Id))
+	}
 
-	if file, err = os.Create(resultFileName(args.Id)); err != nil {
-		log.Fatal(err)
+	if err = injectFaults(ctx, faults, FAULT_AFTER, nil); err != nil {
+		return worker.abandon("reduce", args, err)
 	}
 
-	fileEncoder = json.NewEncoder(file)
+	reply.Counters = task.counters.snapshot()
 
-	for _, value := range reduceResult {
-		fileEncoder.Encode(value)
+	if inputInfo, err = os.Stat(inputName); err == nil {
+		worker.metrics.bytesRead.add("Worker.RunReduce", float64(inputInfo.Size()))
 	}
+	worker.metrics.emitted.add("Worker.RunReduce", float64(emitted))
+	worker.metrics.latency.observe("Worker.RunReduce", time.Since(start).Seconds())
+	return nil
+}
+
+// RPC - Cancel
+// Called by Master when it gave up on an attempt of an operation, so this worker
+// abandons it.
+func (worker *Worker) Cancel(args *CancelArgs, _ *struct{}) error {
+	if worker.cancelOperation(args) {
+		log.Printf("Cancelling %v id: %v, attempt: %v\n", args.Proc, args.Id, args.Attempt)
+	}
+	return nil
+}
+
+// RPC - FetchMapOutput
+// Called by reducers to read the output of a map operation run by this worker for
+// their partition, one chunk at a time.
+func (worker *Worker) FetchMapOutput(args *FetchArgs, reply *FetchReply) error {
+	return readChunk(filepath.Join(workerStorageDir(worker.hostname, args.JobId, args.JobToken), REDUCE_PATH, reduceName(args.MapId, args.ReduceId)), args.Offset, reply)
+}
+
+// RPC - DiscardMapOutput
+// Called by reducers when the output of a map operation run by this worker is corrupt.
+// It's removed, so the output of the next attempt of the map operation is committed.
+func (worker *Worker) DiscardMapOutput(args *FetchArgs, _ *struct{}) error {
+	log.Printf("Discarding corrupt output of map id: %v\n", args.MapId)
+	return os.RemoveAll(filepath.Join(workerStorageDir(worker.hostname, args.JobId, args.JobToken), REDUCE_PATH, mapOutputName(args.MapId)))
+}
+
+// RPC - FetchResult
+// Called by Master to read the result of a reduce operation run by this worker, one
+// chunk at a time.
+func (worker *Worker) FetchResult(args *FetchArgs, reply *FetchReply) error {
+	return readChunk(filepath.Join(resultFileName(workerStorageDir(worker.hostname, args.JobId, args.JobToken), args.ReduceId), WORKER_RESULT_FILE), args.Offset, reply)
+}
 
-	file.Close()
+// RPC - Ping
+// Called periodically by Master to check that this worker is still alive.
+func (worker *Worker) Ping(_ *struct{}, _ *struct{}) error {
+	worker.pinged()
 	return nil
 }
 
@@ -1,7 +1,6 @@
 package main
 
 import (
-	"encoding/json"
 	"fmt"
 	"io"
 	"io/ioutil"
@@ -34,12 +33,12 @@ func fanInData(numFiles int) chan []byte {
 
 	go func() {
 		for i := 0; i < numFiles; i++ {
-			if buffer, err = ioutil.ReadFile(mapFileName(i)); err != nil {
+			if buffer, err = ioutil.ReadFile(mapFileName(MAP_PATH, i)); err != nil {
 				close(input)
 				log.Fatal(err)
 			}
 
-			log.Println("Fanning in file", mapFileName(i))
+			log.Println("Fanning in file", mapFileName(MAP_PATH, i))
 			input <- buffer
 		}
 		close(input)
@@ -47,21 +46,18 @@ func fanInData(numFiles int) chan []byte {
 	return input
 }
 
-// fanInFilePath will run a goroutine that returns the path of files created during
-// splitData. These paths will be sent to remote workers so they can access the data
-// and run map operations on it.
-func fanInFilePath(numFiles int, fileHostname string) chan string {
+// fanInFilePath will run a goroutine that returns the paths returned by splitInput.
+// These paths will be sent to remote workers so they can access the data and run map
+// operations on it.
+func fanInFilePath(filePaths []string) chan string {
 	var (
 		inputChan chan string
-		filePath  string
 	)
 
 	inputChan = make(chan string)
 
 	go func() {
-		for i := 0; i < numFiles; i++ {
-			filePath = mapFileName(i)
-
+		for _, filePath := range filePaths {
 			inputChan <- filePath
 		}
 
@@ -72,12 +68,12 @@ func fanInFilePath(numFiles int, fileHostname string) chan string {
 
 // fanOutData will run a goroutine that receive data on the one-way channel and will
 // proceed to store it in their final destination. The data will come out after the
-// reduce phase of the mapreduce model.
-func fanOutData() (chan []mapreduce.KeyValue, chan bool) {
+// reduce phase of the mapreduce model, written with format.
+func fanOutData(format mapreduce.OutputFormat) (chan []mapreduce.KeyValue, chan bool) {
 	var (
 		err           error
 		file          *os.File
-		fileEncoder   *json.Encoder
+		fileWriter    mapreduce.RecordWriter
 		reduceCounter int
 		output        chan []mapreduce.KeyValue
 		done          chan bool
@@ -93,12 +89,13 @@ func fanOutData() (chan []mapreduce.KeyValue, chan bool) {
 				log.Fatal(err)
 			}
 
-			fileEncoder = json.NewEncoder(file)
+			fileWriter = format.NewWriter(file)
 
 			for _, value := range v {
-				fileEncoder.Encode(value)
+				fileWriter.Write(value)
 			}
 
+			fileWriter.Flush()
 			file.Close()
 			reduceCounter++
 		}
@@ -109,9 +106,60 @@ func fanOutData() (chan []mapreduce.KeyValue, chan bool) {
 	return output, done
 }
 
-// Reads input file and split it into files smaller than chunkSize.
+// inputFormat returns the mapreduce.InputFormat called name, nil for the chunks of
+// splitData. A directory as input is read file by file with that format.
+func inputFormat(name string, fileName string) (format mapreduce.InputFormat, err error) {
+	var info os.FileInfo
+
+	switch name {
+	case "chunks":
+		return nil, nil
+	case "lines":
+		format = mapreduce.TextInputFormat{}
+	case "jsonl":
+		format = mapreduce.JSONLinesInputFormat{}
+	case "csv":
+		format = mapreduce.CSVInputFormat{}
+	default:
+		return nil, fmt.Errorf("unknown input format '%v'", name)
+	}
+
+	if info, err = os.Stat(fileName); err == nil && info.IsDir() {
+		format = mapreduce.DirInputFormat{Format: format, ByteRanges: true}
+	}
+	return format, nil
+}
+
+// outputFormat returns the mapreduce.OutputFormat called name.
+func outputFormat(name string) (mapreduce.OutputFormat, error) {
+	switch name {
+	case "jsonl":
+		return mapreduce.JSONLinesOutputFormat{}, nil
+	case "tsv":
+		return mapreduce.TSVOutputFormat{}, nil
+	case "csv":
+		return mapreduce.CSVOutputFormat{}, nil
+	}
+	return nil, fmt.Errorf("unknown output format '%v'", name)
+}
+
+// splitInput cuts the input file into the splits of format, or into chunks stored in
+// mapPath by splitData when format is nil. Returns the paths read by map operations.
+func splitInput(format mapreduce.InputFormat, fileName string, mapPath string, chunkSize int) ([]string, error) {
+	if format != nil {
+		return mapreduce.SplitInput(format, fileName, int64(chunkSize))
+	}
+
+	numFiles, err := splitData(fileName, mapPath, chunkSize)
+	if err != nil {
+		return nil, err
+	}
+	return mapFilePaths(mapPath, numFiles), nil
+}
+
+// Reads input file and split it into files smaller than chunkSize, stored in mapPath.
 // CUTCUTCUTCUTCUT!
-func splitData(fileName string, chunkSize int) (numMapFiles int, err error) {
+func splitData(fileName string, mapPath string, chunkSize int) (numMapFiles int, err error) {
 	var (
 		file         *os.File
 		tempFile     *os.File
@@ -158,7 +206,7 @@ func splitData(fileName string, chunkSize int) (numMapFiles int, err error) {
 			}
 			paddedBuffer = chunkBuffer[:chunkSize-pad]
 
-			if tempFile, err = os.Create(mapFileName(numMapFiles)); err != nil {
+			if tempFile, err = os.Create(mapFileName(mapPath, numMapFiles)); err != nil {
 				return numMapFiles, err
 			}
 			numMapFiles++
@@ -181,8 +229,17 @@ func splitData(fileName string, chunkSize int) (numMapFiles int, err error) {
 	return numMapFiles, nil
 }
 
-func mapFileName(id int) string {
-	return filepath.Join(MAP_PATH, fmt.Sprintf("map-%v", id))
+func mapFileName(mapPath string, id int) string {
+	return filepath.Join(mapPath, fmt.Sprintf("map-%v", id))
+}
+
+// mapFilePaths returns the paths of the numFiles files created by splitData in mapPath.
+func mapFilePaths(mapPath string, numFiles int) []string {
+	filePaths := make([]string, numFiles)
+	for i := range filePaths {
+		filePaths[i] = mapFileName(mapPath, i)
+	}
+	return filePaths
 }
 
 func resultFileName(id int) string {
@@ -1,39 +1,89 @@
 package main
 
 import (
+	"context"
 	"flag"
 	"labMapReduce/mapreduce"
 	"log"
 	"os"
+	"os/signal"
 	"strconv"
+	"time"
 )
 
 var (
 	// Run mode settings
 	mode       = flag.String("mode", "distributed", "Run mode: distributed or sequential")
-	nodeType   = flag.String("type", "worker", "Node type: master or worker")
+	nodeType   = flag.String("type", "worker", "Node type: master, worker or client")
 	reduceJobs = flag.Int("reducejobs", 5, "Number of reduce jobs that should be run")
+	partition  = flag.String("partition", "hash", "Partitioning of keys between reduce jobs: hash, or range for results in key order")
 
 	// Input data settings
 	file      = flag.String("file", "files/pg1342.txt", "File to use as input")
+	input     = flag.String("input", "chunks", "Input format: chunks, lines, jsonl or csv. A directory as file is read file by file")
 	chunkSize = flag.Int("chunksize", 100*1024, "Size of data chunks that should be passed to map jobs(in bytes)")
+	combine   = flag.Bool("combine", false, "Combine map results before writing intermediate files")
+	sorted    = flag.Bool("sorted", false, "Sort reduce input by key and reduce one key at a time")
+	reduceMem = flag.Int("reducemem", 64*1024*1024, "Memory ceiling of reduce operations (in bytes)")
+	compress  = flag.String("compress", "", "Compression of intermediate files: gzip, flate or zlib (empty for none)")
+	encoding  = flag.String("encoding", "", "Encoding of intermediate files: binary (empty for JSON)")
+
+	// Output data settings
+	output     = flag.String("output", "jsonl", "Output format: jsonl, tsv or csv")
+	sortOutput = flag.Bool("sortoutput", false, "Sort the final result by key, so runs of the same job write identical files")
 
 	// Network settings
 	addr   = flag.String("addr", "localhost", "IP address to listen on")
 	port   = flag.Int("port", 5000, "TCP port to listen on")
 	master = flag.String("master", "localhost:5000", "Master address")
 
-	// Induced failure on Worker
-	nOps = flag.Int("fail", 0, "Number of operations to run before failure")
+	// Failure detection settings
+	heartbeat        = flag.Duration("heartbeat", time.Second, "Interval between heartbeats sent by master to workers")
+	heartbeatTimeout = flag.Duration("heartbeattimeout", 3*time.Second, "Time without heartbeats before a worker is considered failed")
+
+	// Master recovery settings
+	resume = flag.Bool("resume", false, "Resume the job of a master that was interrupted")
+
+	// Long-lived master settings
+	serve = flag.Bool("serve", false, "Keep the master running and accept jobs submitted by clients")
+
+	// Speculative execution settings
+	speculative = flag.Bool("speculative", false, "Start backup attempts of straggler operations")
+	slowdown    = flag.Float64("slowdown", 1.5, "How many times slower than the mean an operation must be to get a backup attempt")
+
+	// Status and metrics server settings
+	status  = flag.String("status", "", "Address where the master serves its status and metrics over HTTP, e.g. localhost:8080")
+	metrics = flag.String("metrics", "", "Address where a worker serves its metrics over HTTP, e.g. localhost:8081")
+
+	// Trace settings
+	trace = flag.String("trace", "", "File the master writes the timeline of the job to, in Chrome trace event format")
+
+	// Locality settings
+	local         = flag.String("local", "", "Glob of the input chunks on the worker's own disk, e.g. 'map/map-*'")
+	localityDelay = flag.Duration("localitydelay", 3*time.Second, "Time a map operation waits for a worker holding its chunk before running on any other")
+
+	// Operation deadline settings
+	timeout = flag.Duration("timeout", 0, "Time an operation attempt may run before it's cancelled (0 for no limit)")
+
+	// Induced failures on Worker
+	faults = flag.String("faults", "", "Fault spec injected by the worker, as a JSON file or inline JSON")
+
+	// Concurrency on Worker
+	slots = flag.Int("slots", 1, "Number of operations the worker runs at the same time")
+
+	// Shorthands for the most common faults, added to the spec
+	nOps     = flag.Int("fail", 0, "Number of operations to run before failure")
+	slowness = flag.Duration("slow", 0, "Delay added to every operation run by the worker")
 )
 
 // Code Entry Point
 func main() {
 	var (
-		err      error
-		task     *mapreduce.Task
-		numFiles int
-		hostname string
+		err       error
+		task      *mapreduce.Task
+		numFiles  int
+		filePaths []string
+		hostname  string
 	)
 
 	flag.Parse()
@@ -44,11 +94,59 @@ func main() {
 	// Initialize mapreduce.Task object with the channels created above and functions
 	// mapFunc, shufflerFunc and reduceFunc defined in wordcount.go
 	task = &mapreduce.Task{
-		Map:           mapFunc,
-		Shuffle:       shuffleFunc,
-		Reduce:        reduceFunc,
-		NumReduceJobs: *reduceJobs,
+		CountingMap:    mapFunc,
+		Shuffle:        shuffleFunc,
+		CountingReduce: reduceFunc,
+		NumReduceJobs:  *reduceJobs,
+
+		ReduceMemoryLimit: *reduceMem,
+		Compression:       mapreduce.Compression(*compress),
+		Encoding:          mapreduce.Encoding(*encoding),
+		HeartbeatInterval: *heartbeat,
+		HeartbeatTimeout:  *heartbeatTimeout,
+
+		Speculative:         *speculative,
+		SpeculativeSlowdown: *slowdown,
+
+		LocalChunks:   *local,
+		LocalityDelay: *localityDelay,
+
+		OperationTimeout: *timeout,
+		StatusAddress:    *status,
+		MetricsAddress:   *metrics,
+		TraceFile:        *trace,
+	}
+
+	// Word counts are sums, so reduceFunc can also collapse the output of each map
+	// operation into a single pair per word before it is written to disk.
+	if *combine {
+		task.CountingCombine = reduceFunc
+	}
+
+	if *sorted {
+		task.CountingReduceByKey = reduceByKeyFunc
+	}
+
+	// Range partitioning samples the words of the input, so each result holds a range
+	// of them and the results are in order one after the other
+	switch *partition {
+	case "hash":
+	case "range":
+		task.Partitioning = mapreduce.PARTITION_RANGE
+	default:
+		log.Fatalf("Unknown partitioning '%v'", *partition)
+	}
+
+	// Any format but chunks gives map operations records instead of chunks
+	if task.InputFormat, err = inputFormat(*input, *file); err != nil {
+		log.Fatal(err)
+	}
+	task.CountingMapRecord = mapRecordFunc
+
+	if task.OutputFormat, err = outputFormat(*output); err != nil {
+		log.Fatal(err)
 	}
+	task.SortedOutput = *sortOutput
 
 	log.Println("Running in", *mode, "mode.")
 
@@ -65,15 +163,22 @@ func main() {
 		_ = RemoveContents(MAP_PATH)
 		_ = RemoveContents(RESULT_PATH)
 
-		// Splits data into chunks with size up to chunkSize
-		if numFiles, err = splitData(*file, *chunkSize); err != nil {
+		// Splits data into chunks with size up to chunkSize, or into the splits of the
+		// input format
+		if filePaths, err = splitInput(task.InputFormat, *file, MAP_PATH, *chunkSize); err != nil {
 			log.Fatal(err)
 		}
+		numFiles = len(filePaths)
 
-		fanIn = fanInData(numFiles)
-		fanOut, waitForIt = fanOutData()
+		fanOut, waitForIt = fanOutData(task.OutputFormat)
 
-		task.InputChan = fanIn
+		// Records are read by the framework, chunks are read here
+		if task.InputFormat != nil {
+			task.InputFilePathChan = fanInFilePath(filePaths)
+		} else {
+			fanIn = fanInData(numFiles)
+			task.InputChan = fanIn
+		}
 		task.OutputChan = fanOut
 
 		mapreduce.RunSequential(task)
@@ -97,38 +202,113 @@ func main() {
 			log.Println("Address:", *addr)
 			log.Println("Port:", *port)
 			log.Println("File:", *file)
+			log.Println("Input Format:", *input)
 			log.Println("Chunk Size:", *chunkSize)
 
+			hostname = *addr + ":" + strconv.Itoa(*port)
+
+			// Interrupting the master stops its jobs and tells the workers to shut down.
+			ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+			defer stop()
+
+			// A long-lived master gets its jobs from clients instead of the input file.
+			if *serve {
+				log.Println("Serving jobs submitted by clients")
+				mapreduce.ServeMaster(ctx, task, hostname)
+				break
+			}
+
+			// A resumed job keeps the chunks and results of the run that was interrupted.
+			// The master reads them from its journal.
+			if *resume {
+				log.Println("Resuming previous job")
+				task.Resume = true
+				mapreduce.RunMaster(ctx, task, hostname)
+				break
+			}
+
 			_ = RemoveContents(MAP_PATH)
 			_ = RemoveContents(RESULT_PATH)
 
-			hostname = *addr + ":" + strconv.Itoa(*port)
-
-			// Splits data into chunks with size up to chunkSize
-			if numFiles, err = splitData(*file, *chunkSize); err != nil {
+			// Splits data into chunks with size up to chunkSize, or into the splits of
+			// the input format
+			if filePaths, err = splitInput(task.InputFormat, *file, MAP_PATH, *chunkSize); err != nil {
 				log.Fatal(err)
 			}
 
 			// Create fan in and out channels for mapreduce.Task
-			fanIn = fanInFilePath(numFiles, hostname)
+			fanIn = fanInFilePath(filePaths)
 			task.InputFilePathChan = fanIn
 
-			mapreduce.RunMaster(task, hostname)
+			mapreduce.RunMaster(ctx, task, hostname)
+
+		case "client":
+			var (
+				mapPath    string
+				jobId      int
+				resultFile string
+			)
+
+			log.Println("NodeType:", *nodeType)
+			log.Println("Reduce Jobs:", *reduceJobs)
+			log.Println("Master:", *master)
+			log.Println("File:", *file)
+			log.Println("Input Format:", *input)
+			log.Println("Chunk Size:", *chunkSize)
+
+			// Every client splits its input in its own directory, so clients can submit
+			// jobs at the same time. Workers read the chunks from there.
+			if mapPath, err = os.MkdirTemp(MAP_PATH, "client-"); err != nil {
+				log.Fatal(err)
+			}
+			defer os.RemoveAll(mapPath)
+
+			if filePaths, err = splitInput(task.InputFormat, *file, mapPath, *chunkSize); err != nil {
+				log.Fatal(err)
+			}
+
+			if jobId, err = mapreduce.SubmitJob(*master, filePaths, *reduceJobs, mapreduce.Encoding(*encoding), task.InputFormat); err != nil {
+				log.Fatal(err)
+			}
+
+			log.Printf("Submitted job %v. Waiting for it to be done.\n", jobId)
+
+			if resultFile, err = mapreduce.WaitJob(*master, jobId); err != nil {
+				log.Fatal(err)
+			}
+
+			log.Printf("Job %v done. Result: %v\n", jobId, resultFile)
 
 		case "worker":
 			log.Println("NodeType:", *nodeType)
 			log.Println("Address:", *addr)
 			log.Println("Port:", *port)
 			log.Println("Master:", *master)
+			log.Println("Slots:", *slots)
+
+			var faultSpec = new(mapreduce.FaultSpec)
+
+			if *faults != "" {
+				if faultSpec, err = mapreduce.LoadFaultSpec(*faults); err != nil {
+					log.Fatal(err)
+				}
+			}
 
 			if *nOps > 0 {
 				log.Println("Induced failure")
 				log.Printf("After %v operations\n", *nOps)
+				faultSpec.Faults = append(faultSpec.Faults, mapreduce.FaultRule{Action: mapreduce.FAULT_CRASH, Point: mapreduce.FAULT_DURING, Nth: *nOps})
+			}
+
+			if *slowness > 0 {
+				log.Println("Induced slowness")
+				log.Printf("Of %v per operation\n", *slowness)
+				faultSpec.Faults = append(faultSpec.Faults, mapreduce.FaultRule{Action: mapreduce.FAULT_DELAY, Delay: slowness.String()})
 			}
 
 			hostname = *addr + ":" + strconv.Itoa(*port)
 
-			mapreduce.RunWorker(task, hostname, *master, *nOps)
+			mapreduce.RunWorker(task, hostname, *master, *slots, faultSpec)
 		}
 	}
 }
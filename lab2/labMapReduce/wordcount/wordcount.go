@@ -1,7 +1,6 @@
 package main
 
 import (
-	"fmt"
 	"hash/fnv"
 	"labMapReduce/mapreduce"
 
@@ -13,7 +12,7 @@ import (
 // mapFunc is called for each array of bytes read from the splitted files. For wordcount
 // it should convert it into an array and parses it into an array of KeyValue that have
 // all the words in the input.
-func mapFunc(input []byte) (result []mapreduce.KeyValue) {
+func mapFunc(input []byte, counters *mapreduce.Counters) (result []mapreduce.KeyValue) {
 	var (
 		text          string
 		delimiterFunc func(c rune) bool
@@ -27,6 +26,7 @@ func mapFunc(input []byte) (result []mapreduce.KeyValue) {
 	}
 
 	words = strings.FieldsFunc(text, delimiterFunc)
+	counters.Add("words", int64(len(words)))
 
 	//fmt.Printf("%v\n", words) //Para ajudar nos testes. Precisa da biblioteca fmt (acima comentada)
 
@@ -45,9 +45,16 @@ func mapFunc(input []byte) (result []mapreduce.KeyValue) {
 	return result
 }
 
+// mapRecordFunc is called for each record read by an InputFormat. Words are counted
+// the same way as in a chunk: a line, JSON document or CSV row is just text.
+func mapRecordFunc(record mapreduce.Record, counters *mapreduce.Counters) []mapreduce.KeyValue {
+	return mapFunc([]byte(record.Value), counters)
+}
+
 // reduceFunc is called for each merged array of KeyValue resulted from all map jobs.
 // It should return a similar array that summarizes all similar keys in the input.
-func reduceFunc(input []mapreduce.KeyValue) (result []mapreduce.KeyValue) {
+// Values that aren't numbers are dropped and counted as "non-numeric values".
+func reduceFunc(input []mapreduce.KeyValue, counters *mapreduce.Counters) (result []mapreduce.KeyValue) {
 	// 	Maybe it's easier if you have an auxiliary structure:
 	//      var mapAux map[string]int = make(map[string]int)
 	//
@@ -76,6 +83,7 @@ func reduceFunc(input []mapreduce.KeyValue) (result []mapreduce.KeyValue) {
 		// Convertemos o valor para inteiro
 		value, err := strconv.Atoi(item.Value)
 		if err != nil {
+			counters.Inc("non-numeric values")
 			continue // Se ocorrer um erro, ignoramos este item
 		}
 		// Somamos o valor ao total correspondente à chave
@@ -91,11 +99,26 @@ func reduceFunc(input []mapreduce.KeyValue) (result []mapreduce.KeyValue) {
 		result = append(result, kv)
 	}
 
-	fmt.Printf("%v\n", result) //Para ajudar nos testes. Precisa da biblioteca fmt (acima comentada)
-
 	return result
 }
 
+// reduceByKeyFunc is the per-key version of reduceFunc. The framework groups the input by
+// word, so it only has to add up the counts it receives for key.
+func reduceByKeyFunc(key string, values *mapreduce.ValueIterator, counters *mapreduce.Counters) (result []mapreduce.KeyValue) {
+	var count int
+
+	for value, ok := values.Next(); ok; value, ok = values.Next() {
+		n, err := strconv.Atoi(value)
+		if err != nil {
+			counters.Inc("non-numeric values")
+			continue // Se ocorrer um erro, ignoramos este item
+		}
+		count += n
+	}
+
+	return []mapreduce.KeyValue{{Key: key, Value: strconv.Itoa(count)}}
+}
+
 // shuffleFunc will shuffle map job results into different job tasks. It should assert that
 // the related keys will be sent to the same job, thus it will hash the key (a word) and assert
 // that the same hash always goes to the same reduce job.